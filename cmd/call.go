@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+)
+
+var callCmd = &cobra.Command{
+	Use:   "call PROTO_FILES",
+	Short: "Send a request with JSON converted to protobuf",
+	Long:  "Send a request to --url the same way the proxy would, converting the JSON body to protobuf and the response back to JSON. The response is printed with its status and timing, with redacted fields masked. With --repeat, the request is sent many times and a summary of the latencies is printed instead.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  callCmdFunc,
+}
+
+func init() {
+	callCmd.Flags().StringVar(&callURL, "url", "", "absolute URL to send the request to")
+	callCmd.MarkFlagRequired("url")
+	callCmd.Flags().StringVarP(&callMethod, "request", "X", "", "HTTP method. Defaults to POST if there is a body and GET otherwise")
+	callCmd.Flags().StringVar(&reqMsg, "req-msg", "", "fully-qualified message type of the request body")
+	callCmd.Flags().StringSliceVar(&respMsgs, "resp-msg", nil, "fully-qualified message types of the response body to try in order")
+	callCmd.Flags().StringVarP(&callData, "data", "d", "", "JSON request body. Use @FILE to read it from a file, or @- to read it from stdin")
+	callCmd.Flags().StringArrayVarP(&callHeaders, "header", "H", nil, "extra request header, given as 'Name: value'. A Content-Type header replaces the one built from --req-msg, --resp-msg and --param")
+	callCmd.Flags().StringArrayVar(&contentTypeParams, "param", nil, "extra Content-Type param, such as qs=proto_body or compress=gzip")
+	callCmd.Flags().BoolVarP(&includeHeaders, "include", "i", false, "print the response headers")
+	callCmd.Flags().IntVar(&repeat, "repeat", 1, "number of times to send the request. More than 1 prints a summary of the latencies instead of the response")
+	callCmd.Flags().IntVar(&concurrency, "concurrency", 1, "number of requests to send at once with --repeat")
+	callCmd.Flags().BoolVar(&noRedact, "no-redact", false, "print the response without masking redacted fields")
+}
+
+// Flags
+var callURL string
+var callMethod string
+var reqMsg string
+var respMsgs []string
+var callData string
+var callHeaders []string
+var contentTypeParams []string
+var includeHeaders bool
+var repeat int
+var concurrency int
+var noRedact bool
+
+func callCmdFunc(command *cobra.Command, protoFiles []string) error {
+	body, err := readData(command)
+	if err != nil {
+		return err
+	}
+	header, err := callHeader()
+	if err != nil {
+		return err
+	}
+	method := callMethod
+	if method == "" {
+		method = http.MethodGet
+		if body != nil {
+			method = http.MethodPost
+		}
+	}
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(strings.ToUpper(method), callURL, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid request: %w", err)
+		}
+		req.Header = header.Clone()
+		return req, nil
+	}
+	if _, err := newRequest(); err != nil {
+		return err
+	}
+
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	srv := server.New(cfg)
+	defer srv.Close()
+
+	if repeat > 1 {
+		return callRepeatedly(command, srv, newRequest)
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	resp, err := srv.Call(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	headersElapsed := time.Since(start)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	stderr := command.ErrOrStderr()
+	fmt.Fprintf(stderr, "%v %v in %v (headers after %v)\n", resp.Proto, resp.Status, elapsed.Round(time.Microsecond), headersElapsed.Round(time.Microsecond))
+	if includeHeaders {
+		names := make([]string, 0, len(resp.Header))
+		for name := range resp.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, v := range resp.Header[name] {
+				fmt.Fprintf(stderr, "%v: %v\n", name, v)
+			}
+		}
+	}
+
+	if !noRedact {
+		// Mask the same fields as payload dumps, since the output is meant for people
+		_, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		if respBody, err = srv.RedactJSON(respBody, strings.Split(params["respmsg"], ",")); err != nil {
+			return fmt.Errorf("Unable to redact response: %w", err)
+		}
+	}
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, respBody, "", "  ") == nil {
+		respBody = append(pretty.Bytes(), '\n')
+	}
+	_, err = command.OutOrStdout().Write(respBody)
+	return err
+}
+
+// readData returns the request body given with --data, or nil if there is none.
+func readData(command *cobra.Command) ([]byte, error) {
+	switch {
+	case callData == "":
+		return nil, nil
+	case callData == "@-":
+		return ioutil.ReadAll(command.InOrStdin())
+	case strings.HasPrefix(callData, "@"):
+		b, err := ioutil.ReadFile(callData[1:])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read request body: %w", err)
+		}
+		return b, nil
+	default:
+		return []byte(callData), nil
+	}
+}
+
+// callHeader returns the request headers from --header, with a Content-Type carrying the message types unless one
+// was given.
+func callHeader() (http.Header, error) {
+	header := http.Header{}
+	for _, h := range callHeaders {
+		i := strings.Index(h, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("Header '%v' must be given as 'Name: value'", h)
+		}
+		header.Add(strings.TrimSpace(h[:i]), strings.TrimSpace(h[i+1:]))
+	}
+	if header.Get("Content-Type") != "" {
+		return header, nil
+	}
+
+	params := map[string]string{}
+	if reqMsg != "" {
+		params["reqMsg"] = reqMsg
+	}
+	if len(respMsgs) > 0 {
+		params["respMsg"] = strings.Join(respMsgs, ",")
+	}
+	for _, p := range contentTypeParams {
+		i := strings.Index(p, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Content-Type param '%v' must be given as key=value", p)
+		}
+		params[p[:i]] = p[i+1:]
+	}
+	contentType := mime.FormatMediaType("application/json", params)
+	if contentType == "" {
+		return nil, fmt.Errorf("Invalid Content-Type params: %v", params)
+	}
+	header.Set("Content-Type", contentType)
+	return header, nil
+}
+
+// callResult is the outcome of one of the requests sent with --repeat.
+type callResult struct {
+	status  int
+	err     error
+	latency time.Duration
+}
+
+// callRepeatedly sends --repeat requests from --concurrency workers and prints a summary.
+func callRepeatedly(command *cobra.Command, srv *server.Server, newRequest func() (*http.Request, error)) error {
+	workers := concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	jobs := make(chan struct{})
+	results := make(chan callResult, repeat)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range jobs {
+				results <- callOnce(srv, newRequest)
+			}
+		}()
+	}
+
+	start := time.Now()
+	for i := 0; i < repeat; i++ {
+		jobs <- struct{}{}
+	}
+	close(jobs)
+	wg.Wait()
+	elapsed := time.Since(start)
+	close(results)
+
+	statuses := map[int]int{}
+	errs := map[string]int{}
+	var latencies []time.Duration
+	var total time.Duration
+	for r := range results {
+		if r.err != nil {
+			errs[r.err.Error()]++
+			continue
+		}
+		statuses[r.status]++
+		latencies = append(latencies, r.latency)
+		total += r.latency
+	}
+
+	w := command.OutOrStdout()
+	fmt.Fprintf(w, "Requests:  %v in %v (%.1f/s) with concurrency %v\n", repeat, elapsed.Round(time.Millisecond), float64(repeat)/elapsed.Seconds(), workers)
+	codes := make([]int, 0, len(statuses))
+	for code := range statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(w, "Status:    %v %v: %v\n", code, http.StatusText(code), statuses[code])
+	}
+	for msg, n := range errs {
+		fmt.Fprintf(w, "Error:     %v: %v\n", msg, n)
+	}
+	if len(latencies) == 0 {
+		return nil
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Fprintf(w, "Latency:   min %v, mean %v, p50 %v, p90 %v, p99 %v, max %v\n",
+		percentile(0), (total / time.Duration(len(latencies))).Round(time.Microsecond),
+		percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	return nil
+}
+
+func callOnce(srv *server.Server, newRequest func() (*http.Request, error)) callResult {
+	req, err := newRequest()
+	if err != nil {
+		return callResult{err: err}
+	}
+	start := time.Now()
+	resp, err := srv.Call(req)
+	if err != nil {
+		return callResult{err: err}
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return callResult{status: resp.StatusCode, err: err, latency: time.Since(start)}
+}
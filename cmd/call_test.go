@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCallHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		headers  []string
+		reqMsg   string
+		respMsgs []string
+		params   []string
+		expected http.Header
+		err      string
+	}{
+		{
+			name:     "content type from the message types",
+			reqMsg:   "testprotos.Req",
+			respMsgs: []string{"testprotos.Resp", "testprotos.Resp2"},
+			expected: http.Header{"Content-Type": {`application/json; reqmsg=testprotos.Req; respmsg="testprotos.Resp,testprotos.Resp2"`}},
+		},
+		{
+			name:     "params",
+			respMsgs: []string{"testprotos.Resp"},
+			params:   []string{"qs=proto_body", "compress=gzip"},
+			expected: http.Header{"Content-Type": {`application/json; compress=gzip; qs=proto_body; respmsg=testprotos.Resp`}},
+		},
+		{
+			name:     "headers are trimmed",
+			headers:  []string{" X-Trace :  abc ", "Accept:text/plain"},
+			expected: http.Header{"X-Trace": {"abc"}, "Accept": {"text/plain"}, "Content-Type": {"application/json"}},
+		},
+		{
+			name:     "content type header replaces the built one",
+			headers:  []string{"Content-Type: application/x-protobuf; respMsg=testprotos.Resp"},
+			reqMsg:   "testprotos.Req",
+			params:   []string{"qs=proto_body"},
+			expected: http.Header{"Content-Type": {"application/x-protobuf; respMsg=testprotos.Resp"}},
+		},
+		{
+			name:    "header without a colon",
+			headers: []string{"X-Trace abc"},
+			err:     "Header 'X-Trace abc' must be given as 'Name: value'",
+		},
+		{
+			name:   "param without a value",
+			params: []string{"qs"},
+			err:    "Content-Type param 'qs' must be given as key=value",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			callHeaders, reqMsg, respMsgs, contentTypeParams = tc.headers, tc.reqMsg, tc.respMsgs, tc.params
+			t.Cleanup(func() {
+				callHeaders, reqMsg, respMsgs, contentTypeParams = nil, "", nil, nil
+			})
+			header, err := callHeader()
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.err, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, header)
+		})
+	}
+}
+
+func TestCallCommand(t *testing.T) {
+	// The backend echoes the text of the request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var req testprotos.Req
+		require.NoError(t, proto.Unmarshal(body, &req))
+		resp, err := proto.Marshal(&testprotos.Resp{Text: req.Text})
+		require.NoError(t, err)
+		w.Write(resp)
+	}))
+	defer backend.Close()
+
+	args := []string{"call", "-I", "../internal/testprotos", "hello.proto", "--url", backend.URL, "--req-msg", "testprotos.Req", "--resp-msg", "testprotos.Resp"}
+	inputFile := filepath.Join(t.TempDir(), "req.json")
+	require.NoError(t, ioutil.WriteFile(inputFile, []byte(`{"text":"from file"}`), 0644))
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected []string
+		err      string
+	}{
+		{
+			name:     "data",
+			args:     []string{"-d", `{"text":"hi"}`},
+			expected: []string{"{\n  \"text\": \"hi\"\n}\n"},
+		},
+		{
+			name:     "data from a file",
+			args:     []string{"--data", "@" + inputFile},
+			expected: []string{"{\n  \"text\": \"from file\"\n}\n"},
+		},
+		{
+			name:     "data from stdin",
+			args:     []string{"-d", "@-"},
+			stdin:    `{"text":"from stdin"}`,
+			expected: []string{"{\n  \"text\": \"from stdin\"\n}\n"},
+		},
+		{
+			name:     "repeat",
+			args:     []string{"-d", `{"text":"hi"}`, "--repeat", "5", "--concurrency", "2"},
+			expected: []string{"Requests:  5 in ", "with concurrency 2\n", "Status:    200 OK: 5\n", "Latency:   min "},
+		},
+		{
+			name: "missing file",
+			args: []string{"-d", "@" + filepath.Join(t.TempDir(), "missing.json")},
+			err:  "Unable to read request body",
+		},
+		{
+			name: "invalid header",
+			args: []string{"-d", `{"text":"hi"}`, "-H", "X-Trace"},
+			err:  "Header 'X-Trace' must be given as 'Name: value'",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runCommand(t, []byte(tc.stdin), append(append([]string{}, args...), tc.args...)...)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			if len(tc.expected) == 1 {
+				assert.Equal(t, tc.expected[0], string(out))
+				return
+			}
+			for _, s := range tc.expected {
+				assert.Contains(t, string(out), s)
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultConfigFile is read from the current directory when --config and PROTOXY_CONFIG aren't given.
+const defaultConfigFile = "protoxy.yaml"
+
+// envPrefix starts the name of the environment variable for each flag, such as PROTOXY_IMPORT_PATHS.
+const envPrefix = "PROTOXY_"
+
+// Settings that are only read from the config file and environment, since they have no flag.
+const (
+	protosSetting    = "protos"
+	upstreamsSetting = "upstreams"
+)
+
+// Settings without a flag
+var protos []string
+var upstreams map[string]server.TransportConfig
+
+// loadSettings sets the flags of command that weren't given on the command line from PROTOXY_* environment variables,
+// then from the config file. It also loads the protos and upstreams settings. Keys of the config file for flags of
+// other commands are accepted but ignored, so one file can serve every command.
+func loadSettings(command *cobra.Command) error {
+	path, settings, err := readConfigFile(command.Flags())
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{protosSetting: true, upstreamsSetting: true}
+	addFlagNames(command.Root(), known)
+	delete(known, "config")
+	delete(known, "help")
+	for key := range settings {
+		if !known[key] {
+			return fmt.Errorf("Unknown setting '%v' in %v", key, path)
+		}
+	}
+
+	flags := command.Flags()
+	var all []*pflag.Flag
+	flags.VisitAll(func(f *pflag.Flag) { all = append(all, f) })
+	for _, f := range all {
+		if f.Changed || f.Name == "config" || f.Name == "help" {
+			continue
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := flags.Set(f.Name, v); err != nil {
+				return fmt.Errorf("Invalid %v: %w", envName(f.Name), err)
+			}
+			continue
+		}
+		if v, ok := settings[f.Name]; ok {
+			if err := setFromYAML(flags, f, v); err != nil {
+				return fmt.Errorf("Invalid setting '%v' in %v: %w", f.Name, path, err)
+			}
+		}
+	}
+
+	if v, ok := os.LookupEnv(envName(protosSetting)); ok {
+		protos = nil
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				protos = append(protos, p)
+			}
+		}
+	} else if v, ok := settings[protosSetting]; ok {
+		if protos, err = yamlStrings(v); err != nil {
+			return fmt.Errorf("Invalid setting '%v' in %v: %w", protosSetting, path, err)
+		}
+	}
+
+	return loadUpstreams(path, settings[upstreamsSetting])
+}
+
+// readConfigFile returns the path and settings of the config file, or no settings if there is none.
+func readConfigFile(flags *pflag.FlagSet) (string, map[string]interface{}, error) {
+	path := configFile
+	if !flags.Changed("config") {
+		path = os.Getenv(envName("config"))
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err != nil {
+			return "", nil, nil
+		}
+		path = defaultConfigFile
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to read config file: %w", err)
+	}
+	settings := map[string]interface{}{}
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return "", nil, fmt.Errorf("Invalid config file %v: %w", path, err)
+	}
+	return path, settings, nil
+}
+
+// loadUpstreams builds the TransportConfig of each upstream from the upstreams setting of the config file and
+// PROTOXY_UPSTREAMS. Each one starts from the global transport flags, and the environment replaces whole upstreams.
+func loadUpstreams(path string, fileSetting interface{}) error {
+	sections := map[string]interface{}{}
+	if fileSetting != nil {
+		m, ok := fileSetting.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid setting '%v' in %v: expected a map of upstream hosts", upstreamsSetting, path)
+		}
+		for host, v := range m {
+			sections[host] = v
+		}
+	}
+	if v, ok := os.LookupEnv(envName(upstreamsSetting)); ok {
+		m := map[string]interface{}{}
+		if err := yaml.Unmarshal([]byte(v), &m); err != nil {
+			return fmt.Errorf("Invalid %v: %w", envName(upstreamsSetting), err)
+		}
+		for host, v := range m {
+			sections[host] = v
+		}
+		path = envName(upstreamsSetting)
+	}
+
+	upstreams = map[string]server.TransportConfig{}
+	for host, section := range sections {
+		settings, ok := section.(map[string]interface{})
+		if !ok && section != nil {
+			return fmt.Errorf("Invalid upstream '%v' in %v: expected a map of settings", host, path)
+		}
+		cfg := transport
+		flags := pflag.NewFlagSet(host, pflag.ContinueOnError)
+		addUpstreamFlags(flags, &cfg, transport)
+		for key, v := range settings {
+			f := flags.Lookup(key)
+			if f == nil {
+				return fmt.Errorf("Unknown setting '%v' for upstream '%v' in %v", key, host, path)
+			}
+			if err := setFromYAML(flags, f, v); err != nil {
+				return fmt.Errorf("Invalid setting '%v' for upstream '%v' in %v: %w", key, host, path, err)
+			}
+		}
+		upstreams[host] = cfg
+	}
+	return nil
+}
+
+// setFromYAML sets f to v as if it was given on the command line. Lists set the flag once for each element, and maps
+// once for each key=value pair.
+func setFromYAML(flags *pflag.FlagSet, f *pflag.Flag, v interface{}) error {
+	var values []string
+	_, scalar := v.(string)
+	csvValue := strings.HasSuffix(f.Value.Type(), "Slice") || f.Value.Type() == "stringToString"
+	switch v := v.(type) {
+	case []interface{}:
+		if !csvValue && f.Value.Type() != "stringArray" {
+			return fmt.Errorf("expected a single %v, not a list", f.Value.Type())
+		}
+		for _, e := range v {
+			s, err := yamlScalar(e)
+			if err != nil {
+				return err
+			}
+			values = append(values, s)
+		}
+	case map[string]interface{}:
+		if f.Value.Type() != "stringToString" {
+			return fmt.Errorf("expected a %v, not a map", f.Value.Type())
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s, err := yamlScalar(v[k])
+			if err != nil {
+				return err
+			}
+			values = append(values, k+"="+s)
+		}
+	default:
+		s, err := yamlScalar(v)
+		if err != nil {
+			return err
+		}
+		values = []string{s}
+	}
+
+	// Values of these flags are parsed as CSV, so list elements with commas or quotes must be quoted. A single string
+	// is split on commas, as it would be on the command line.
+	for _, s := range values {
+		if csvValue && !scalar {
+			s = csvQuote(s)
+		}
+		if err := flags.Set(f.Name, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func yamlScalar(v interface{}) (string, error) {
+	switch v.(type) {
+	case []interface{}, map[string]interface{}:
+		return "", fmt.Errorf("expected a single value, not %v", v)
+	case nil:
+		return "", nil
+	}
+	return fmt.Sprint(v), nil
+}
+
+// yamlStrings returns v as a list of strings. A single value is a list of one.
+func yamlStrings(v interface{}) ([]string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		list = []interface{}{v}
+	}
+	var strs []string
+	for _, e := range list {
+		s, err := yamlScalar(e)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func csvQuote(s string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{s})
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// addFlagNames adds the names of the flags of c and all its subcommands to names.
+func addFlagNames(c *cobra.Command, names map[string]bool) {
+	add := func(f *pflag.Flag) { names[f.Name] = true }
+	c.LocalFlags().VisitAll(add)
+	c.PersistentFlags().VisitAll(add)
+	for _, sub := range c.Commands() {
+		addFlagNames(sub, names)
+	}
+}
+
+// envName returns the environment variable for a flag or setting, such as PROTOXY_IMPORT_PATHS for import-paths.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSettings holds the flags of the commands built by newTestCommand.
+type testSettings struct {
+	importPaths []string
+	headers     map[string]string
+	port        uint16
+	routes      []string
+}
+
+// newTestCommand returns a serve command under a fresh root, with a docs command beside it that has its own flag.
+func newTestCommand() (*cobra.Command, *testSettings) {
+	settings := &testSettings{}
+	root := &cobra.Command{Use: "protoxy"}
+	root.PersistentFlags().StringVar(&configFile, "config", "", "")
+	root.PersistentFlags().StringSliceVarP(&settings.importPaths, "import-paths", "I", nil, "")
+	root.PersistentFlags().Uint16Var(&settings.port, "port", 7777, "")
+	serve := &cobra.Command{Use: "serve", Run: func(*cobra.Command, []string) {}}
+	serve.Flags().StringToStringVar(&settings.headers, "resp-header", nil, "")
+	docs := &cobra.Command{Use: "docs", Run: func(*cobra.Command, []string) {}}
+	docs.Flags().StringArrayVar(&settings.routes, "route", nil, "")
+	root.AddCommand(serve, docs)
+	return serve, settings
+}
+
+func TestLoadSettings(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		env       map[string]string
+		args      []string
+		expected  testSettings
+		protos    []string
+		upstreams map[string]server.TransportConfig
+		err       string
+	}{
+		{
+			name:     "defaults",
+			expected: testSettings{port: 7777},
+		},
+		{
+			name:     "config file",
+			file:     "port: 8080\nimport-paths:\n  - ./protos/\n",
+			expected: testSettings{port: 8080, importPaths: []string{"./protos/"}},
+		},
+		{
+			name:     "environment over config file",
+			file:     "port: 8080\nimport-paths:\n  - ./protos/\n",
+			env:      map[string]string{"PROTOXY_PORT": "9090"},
+			expected: testSettings{port: 9090, importPaths: []string{"./protos/"}},
+		},
+		{
+			name:     "flags over environment",
+			file:     "port: 8080\n",
+			env:      map[string]string{"PROTOXY_PORT": "9090", "PROTOXY_IMPORT_PATHS": "./a/,./b/"},
+			args:     []string{"--port", "7000"},
+			expected: testSettings{port: 7000, importPaths: []string{"./a/", "./b/"}},
+		},
+		{
+			name:     "list elements are quoted",
+			file:     "import-paths:\n  - ./a,b/\n  - './c\"d/'\n",
+			expected: testSettings{port: 7777, importPaths: []string{"./a,b/", `./c"d/`}},
+		},
+		{
+			name:     "single string is split like a flag",
+			file:     "import-paths: ./a/,./b/\n",
+			expected: testSettings{port: 7777, importPaths: []string{"./a/", "./b/"}},
+		},
+		{
+			name:     "string map",
+			file:     "resp-header:\n  X-Meta: example.Meta\n  X-List: a,b\n",
+			expected: testSettings{port: 7777, headers: map[string]string{"X-Meta": "example.Meta", "X-List": "a,b"}},
+		},
+		{
+			name:     "string map from the environment",
+			env:      map[string]string{"PROTOXY_RESP_HEADER": "X-Meta=example.Meta"},
+			expected: testSettings{port: 7777, headers: map[string]string{"X-Meta": "example.Meta"}},
+		},
+		{
+			name:     "protos",
+			file:     "protos:\n  - a.proto\n  - b.proto\n",
+			expected: testSettings{port: 7777},
+			protos:   []string{"a.proto", "b.proto"},
+		},
+		{
+			name:     "protos from the environment",
+			file:     "protos:\n  - a.proto\n",
+			env:      map[string]string{"PROTOXY_PROTOS": "c.proto, d.proto"},
+			expected: testSettings{port: 7777},
+			protos:   []string{"c.proto", "d.proto"},
+		},
+		{
+			name:     "upstream sections",
+			file:     "upstreams:\n  api.example.com:8443:\n    dial-timeout: 5s\n    retries: 3\n  legacy.internal:\n",
+			expected: testSettings{port: 7777},
+			upstreams: map[string]server.TransportConfig{
+				"api.example.com:8443": withTransport(func(cfg *server.TransportConfig) {
+					cfg.DialTimeout = 5 * time.Second
+					cfg.Retries = 3
+				}),
+				"legacy.internal": transport,
+			},
+		},
+		{
+			name:     "environment replaces upstreams",
+			file:     "upstreams:\n  api.example.com:\n    retries: 3\n  legacy.internal:\n    retries: 1\n",
+			env:      map[string]string{"PROTOXY_UPSTREAMS": `{"api.example.com": {"tls-insecure-skip-verify": true}}`},
+			expected: testSettings{port: 7777},
+			upstreams: map[string]server.TransportConfig{
+				"api.example.com": withTransport(func(cfg *server.TransportConfig) { cfg.TLSInsecureSkipVerify = true }),
+				"legacy.internal": withTransport(func(cfg *server.TransportConfig) { cfg.Retries = 1 }),
+			},
+		},
+		{
+			name:     "flags of other commands are ignored",
+			file:     "route:\n  - GET /v1/items=example.Item:example.Item\n",
+			expected: testSettings{port: 7777},
+		},
+		{
+			name: "unknown key",
+			file: "bogus: 1\n",
+			err:  "Unknown setting 'bogus'",
+		},
+		{
+			name: "unknown upstream key",
+			file: "upstreams:\n  api.example.com:\n    port: 1\n",
+			err:  "Unknown setting 'port' for upstream 'api.example.com'",
+		},
+		{
+			name: "invalid value in the config file",
+			file: "port: lots\n",
+			err:  "Invalid setting 'port'",
+		},
+		{
+			name: "invalid value in the environment",
+			env:  map[string]string{"PROTOXY_PORT": "lots"},
+			err:  "Invalid PROTOXY_PORT",
+		},
+		{
+			name: "list for a single value",
+			file: "port:\n  - 1\n  - 2\n",
+			err:  "Invalid setting 'port'",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			protos = nil
+			for name, v := range tc.env {
+				t.Setenv(name, v)
+			}
+			command, settings := newTestCommand()
+			args := tc.args
+			if tc.file != "" {
+				path := filepath.Join(t.TempDir(), "protoxy.yaml")
+				require.NoError(t, ioutil.WriteFile(path, []byte(tc.file), 0644))
+				args = append(args, "--config", path)
+			}
+			require.NoError(t, command.ParseFlags(args))
+
+			err := loadSettings(command)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, *settings)
+			assert.Equal(t, tc.protos, protos)
+			if tc.upstreams == nil {
+				tc.upstreams = map[string]server.TransportConfig{}
+			}
+			assert.Equal(t, tc.upstreams, upstreams)
+		})
+	}
+}
+
+// withTransport returns the transport flags with the changes made by fn.
+func withTransport(fn func(cfg *server.TransportConfig)) server.TransportConfig {
+	cfg := transport
+	fn(&cfg)
+	return cfg
+}
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// encodingBinary writes or reads protobuf as raw bytes rather than text.
+const encodingBinary = "binary"
+
+var encodeCmd = &cobra.Command{
+	Use:   "encode PROTO_FILES",
+	Short: "Convert JSON to protobuf",
+	Long:  "Convert JSON from stdin or --file to protobuf, the same way the proxy converts request bodies. The result is written to stdout.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  encodeCmdFunc,
+}
+
+var decodeCmd = &cobra.Command{
+	Use:   "decode PROTO_FILES",
+	Short: "Convert protobuf to JSON",
+	Long:  "Convert protobuf from stdin or --file to JSON, the same way the proxy converts response bodies. The result is written to stdout.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  decodeCmdFunc,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{encodeCmd, decodeCmd} {
+		c.Flags().StringVarP(&inputFile, "file", "f", "", "read input from this file instead of stdin")
+		c.Flags().StringVar(&encoding, "encoding", encodingBinary, "how the protobuf is written: binary, or a query string encoding: url, rawurl, std, rawstd or hex")
+		c.Flags().BoolVar(&delimited, "delimited", false, "use a stream of varint length-delimited messages. The JSON side is a sequence of JSON values")
+	}
+	encodeCmd.Flags().StringVarP(&messageType, "type", "t", "", "fully-qualified message type of the JSON. Required unless --raw-fallback is set")
+	decodeCmd.Flags().StringSliceVarP(&messageTypes, "type", "t", nil, "fully-qualified message types to try in order. Required unless --raw-fallback is set")
+}
+
+// Flags
+var inputFile string
+var encoding string
+var delimited bool
+var messageType string
+var messageTypes []string
+
+func encodeCmdFunc(command *cobra.Command, protoFiles []string) error {
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	srv := server.New(cfg)
+	input, err := readInput(command)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	if delimited {
+		dec := json.NewDecoder(bytes.NewReader(input))
+		for {
+			var js json.RawMessage
+			err := dec.Decode(&js)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("Invalid JSON input: %w", err)
+			}
+			b, err := srv.EncodeJSON(js, messageType)
+			if err != nil {
+				return err
+			}
+			out = protowire.AppendVarint(out, uint64(len(b)))
+			out = append(out, b...)
+		}
+	} else {
+		out, err = srv.EncodeJSON(input, messageType)
+		if err != nil {
+			return err
+		}
+	}
+
+	if encoding == encodingBinary {
+		_, err = command.OutOrStdout().Write(out)
+		return err
+	}
+	text, err := server.EncodeBytes(out, encoding)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(command.OutOrStdout(), text)
+	return err
+}
+
+func decodeCmdFunc(command *cobra.Command, protoFiles []string) error {
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	srv := server.New(cfg)
+	input, err := readInput(command)
+	if err != nil {
+		return err
+	}
+	if encoding != encodingBinary {
+		input, err = server.DecodeBytes(strings.TrimSpace(string(input)), encoding)
+		if err != nil {
+			return fmt.Errorf("Invalid %v input: %w", encoding, err)
+		}
+	}
+
+	// Every message is written as a line of JSON
+	out := command.OutOrStdout()
+	if !delimited {
+		js, err := srv.DecodeProto(input, messageTypes)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, string(js))
+		return err
+	}
+	for len(input) > 0 {
+		size, n := protowire.ConsumeVarint(input)
+		if n < 0 || uint64(len(input)-n) < size {
+			return fmt.Errorf("Invalid delimited input: truncated message")
+		}
+		js, err := srv.DecodeProto(input[n:n+int(size)], messageTypes)
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(out, string(js)); err != nil {
+			return err
+		}
+		input = input[n+int(size):]
+	}
+	return nil
+}
+
+// readInput reads all of --file, or stdin if no file is given.
+func readInput(command *cobra.Command) ([]byte, error) {
+	if inputFile == "" {
+		return ioutil.ReadAll(command.InOrStdin())
+	}
+	b, err := os.ReadFile(inputFile)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read input: %w", err)
+	}
+	return b, nil
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runCommand runs protoxy with args, reading stdin, and returns what it wrote to stdout. The flags are kept in
+// package variables, so they are reset to their defaults first.
+func runCommand(t *testing.T, stdin []byte, args ...string) ([]byte, error) {
+	resetFlags(rootCmd.PersistentFlags())
+	for _, c := range rootCmd.Commands() {
+		resetFlags(c.Flags())
+	}
+	protos, upstreams = nil, nil
+
+	var out bytes.Buffer
+	rootCmd.SetIn(bytes.NewReader(stdin))
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(ioutil.Discard)
+	rootCmd.SetArgs(args)
+	rootCmd.SilenceUsage, rootCmd.SilenceErrors = true, true
+	t.Cleanup(func() {
+		rootCmd.SetIn(nil)
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+		rootCmd.SetArgs(nil)
+		rootCmd.SilenceUsage, rootCmd.SilenceErrors = false, false
+	})
+	_, err := rootCmd.ExecuteC()
+	return out.Bytes(), err
+}
+
+func resetFlags(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if s, ok := f.Value.(pflag.SliceValue); ok {
+			s.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+}
+
+// The encoding of testprotos.Req{Text: "??"} in each of the --encoding modes.
+var encodedReq = map[string]string{
+	"url":    "CgI_Pw==",
+	"rawurl": "CgI_Pw",
+	"std":    "CgI/Pw==",
+	"rawstd": "CgI/Pw",
+	"hex":    "0a023f3f",
+}
+
+func TestEncodeCommand(t *testing.T) {
+	protoArgs := []string{"-I", "../internal/testprotos", "hello.proto"}
+	inputFile := filepath.Join(t.TempDir(), "req.json")
+	require.NoError(t, ioutil.WriteFile(inputFile, []byte(`{"text":"hi"}`), 0644))
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected string
+		err      string
+	}{
+		{
+			name:     "binary from stdin",
+			args:     []string{"-t", "testprotos.Req"},
+			stdin:    `{"text":"hi","number":5}`,
+			expected: "\x0a\x02hi\x10\x05",
+		},
+		{
+			name:     "file",
+			args:     []string{"-t", "testprotos.Req", "--file", inputFile},
+			expected: "\x0a\x02hi",
+		},
+		{
+			name:     "delimited",
+			args:     []string{"-t", "testprotos.Req", "--delimited"},
+			stdin:    "{\"text\":\"hi\"}\n{\"number\":5}\n",
+			expected: "\x04\x0a\x02hi\x02\x10\x05",
+		},
+		{
+			name:     "delimited hex",
+			args:     []string{"-t", "testprotos.Req", "--delimited", "--encoding", "hex"},
+			stdin:    `{"text":"??"} {}`,
+			expected: "040a023f3f00\n",
+		},
+		{
+			name:     "raw fallback",
+			args:     []string{"--raw-fallback"},
+			stdin:    `{"1":"hi"}`,
+			expected: "\x0a\x02hi",
+		},
+		{
+			name:  "type required",
+			stdin: `{"text":"hi"}`,
+			err:   "A message type is required",
+		},
+		{
+			name:  "unknown type",
+			args:  []string{"-t", "testprotos.Missing"},
+			stdin: `{"text":"hi"}`,
+			err:   "Failed to find message descriptor for 'testprotos.Missing'",
+		},
+		{
+			name:  "invalid JSON",
+			args:  []string{"-t", "testprotos.Req"},
+			stdin: `{"text":`,
+			err:   "Unable to unmarshal",
+		},
+		{
+			name:  "invalid delimited JSON",
+			args:  []string{"-t", "testprotos.Req", "--delimited"},
+			stdin: `{"text":"hi"} {"text":`,
+			err:   "Invalid JSON input",
+		},
+		{
+			name:  "unknown encoding",
+			args:  []string{"-t", "testprotos.Req", "--encoding", "base32"},
+			stdin: `{"text":"hi"}`,
+			err:   "unknown query string encoding 'base32'",
+		},
+		{
+			name: "missing file",
+			args: []string{"-t", "testprotos.Req", "--file", filepath.Join(t.TempDir(), "missing.json")},
+			err:  "Unable to read input",
+		},
+	}
+	for encoding, expected := range encodedReq {
+		tests = append(tests, struct {
+			name     string
+			args     []string
+			stdin    string
+			expected string
+			err      string
+		}{
+			name:     encoding + " encoding",
+			args:     []string{"-t", "testprotos.Req", "--encoding", encoding},
+			stdin:    `{"text":"??"}`,
+			expected: expected + "\n",
+		})
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runCommand(t, []byte(tc.stdin), append(append([]string{"encode"}, protoArgs...), tc.args...)...)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(out))
+		})
+	}
+}
+
+func TestDecodeCommand(t *testing.T) {
+	protoArgs := []string{"-I", "../internal/testprotos", "hello.proto"}
+	inputFile := filepath.Join(t.TempDir(), "req.bin")
+	require.NoError(t, ioutil.WriteFile(inputFile, []byte("\x0a\x02hi"), 0644))
+
+	tests := []struct {
+		name     string
+		args     []string
+		stdin    string
+		expected string
+		err      string
+	}{
+		{
+			name:     "binary from stdin",
+			args:     []string{"-t", "testprotos.Req"},
+			stdin:    "\x0a\x02hi\x10\x05",
+			expected: `{"text":"hi","number":5,"list":[]}` + "\n",
+		},
+		{
+			name:     "file",
+			args:     []string{"-t", "testprotos.Req", "--file", inputFile},
+			expected: `{"text":"hi","number":0,"list":[]}` + "\n",
+		},
+		{
+			name:     "first of several types",
+			args:     []string{"-t", "testprotos.Req,testprotos.Resp2"},
+			stdin:    "\x0a\x02hi",
+			expected: `{"text":"hi","number":0,"list":[]}` + "\n",
+		},
+		{
+			name:     "delimited",
+			args:     []string{"-t", "testprotos.Req", "--delimited"},
+			stdin:    "\x04\x0a\x02hi\x02\x10\x05",
+			expected: `{"text":"hi","number":0,"list":[]}` + "\n" + `{"text":"","number":5,"list":[]}` + "\n",
+		},
+		{
+			name:     "delimited hex",
+			args:     []string{"-t", "testprotos.Req", "--delimited", "--encoding", "hex"},
+			stdin:    "040a023f3f00\n",
+			expected: `{"text":"??","number":0,"list":[]}` + "\n" + `{"text":"","number":0,"list":[]}` + "\n",
+		},
+		{
+			name:     "raw fallback",
+			args:     []string{"--raw-fallback"},
+			stdin:    "\x0a\x02hi",
+			expected: `{"1":"hi"}` + "\n",
+		},
+		{
+			name:  "type required",
+			stdin: "\x0a\x02hi",
+			err:   "A message type is required",
+		},
+		{
+			name:  "unknown type",
+			args:  []string{"-t", "testprotos.Missing"},
+			stdin: "\x0a\x02hi",
+			err:   "Failed to find message descriptor for 'testprotos.Missing'",
+		},
+		{
+			name:  "invalid protobuf",
+			args:  []string{"-t", "testprotos.Req"},
+			stdin: "\x0a\x05hi",
+			err:   "Unable to unmarshal",
+		},
+		{
+			name:  "truncated delimited input",
+			args:  []string{"-t", "testprotos.Req", "--delimited"},
+			stdin: "\x04\x0a\x02hi\x05\x10",
+			err:   "Invalid delimited input: truncated message",
+		},
+		{
+			name:  "invalid encoded input",
+			args:  []string{"-t", "testprotos.Req", "--encoding", "hex"},
+			stdin: "not hex",
+			err:   "Invalid hex input",
+		},
+		{
+			name:  "unknown encoding",
+			args:  []string{"-t", "testprotos.Req", "--encoding", "base32"},
+			stdin: "CgI_Pw==",
+			err:   "unknown query string encoding 'base32'",
+		},
+	}
+	for encoding, encoded := range encodedReq {
+		tests = append(tests, struct {
+			name     string
+			args     []string
+			stdin    string
+			expected string
+			err      string
+		}{
+			name:     encoding + " encoding",
+			args:     []string{"-t", "testprotos.Req", "--encoding", encoding},
+			stdin:    encoded + "\n",
+			expected: `{"text":"??","number":0,"list":[]}` + "\n",
+		})
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := runCommand(t, []byte(tc.stdin), append(append([]string{"decode"}, protoArgs...), tc.args...)...)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(out))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list PROTO_FILES",
+	Short: "List the messages, enums and services in proto files",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  listCmdFunc,
+}
+
+var describeCmd = &cobra.Command{
+	Use:   "describe PROTO_FILES",
+	Short: "Describe a message, enum or service",
+	Long:  "Print the fields, types, numbers and comments of a message, enum or service. Messages also get a sample JSON body with every field set.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  describeCmdFunc,
+}
+
+func init() {
+	for _, c := range []*cobra.Command{listCmd, describeCmd} {
+		c.Flags().BoolVar(&jsonOutput, "json", false, "print machine-readable JSON")
+	}
+	describeCmd.Flags().StringVarP(&messageType, "type", "t", "", "fully-qualified name of the message, enum or service")
+	describeCmd.MarkFlagRequired("type")
+}
+
+// Flags
+var jsonOutput bool
+
+func listCmdFunc(command *cobra.Command, protoFiles []string) error {
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	schema := server.New(cfg).Schema()
+	if jsonOutput {
+		return printJSON(command, schema)
+	}
+
+	w := command.OutOrStdout()
+	printNames := func(title string, names []string) {
+		fmt.Fprintf(w, "%v:\n", title)
+		for _, n := range names {
+			fmt.Fprintf(w, "  %v\n", n)
+		}
+	}
+	printNames("Messages", schema.Messages)
+	printNames("Enums", schema.Enums)
+	fmt.Fprintln(w, "Services:")
+	for _, svc := range schema.Services {
+		fmt.Fprintf(w, "  %v\n", svc.Name)
+		for _, m := range svc.Methods {
+			fmt.Fprintf(w, "    %v\n", signature(m))
+		}
+	}
+	return nil
+}
+
+func describeCmdFunc(command *cobra.Command, protoFiles []string) error {
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	d, err := server.New(cfg).Describe(messageType)
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(command, d)
+	}
+
+	w := command.OutOrStdout()
+	fmt.Fprintf(w, "%v %v\n", d.Kind, d.Name)
+	if d.Comment != "" {
+		fmt.Fprintln(w, commentLines(d.Comment))
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch d.Kind {
+	case "message":
+		fmt.Fprintln(tw, "NUMBER\tFIELD\tTYPE\tCOMMENT")
+		for _, f := range d.Fields {
+			name := f.JSONName
+			if f.Oneof != "" {
+				name = fmt.Sprintf("%v (oneof %v)", name, f.Oneof)
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", f.Number, name, f.Type, firstLine(f.Comment))
+		}
+	case "enum":
+		fmt.Fprintln(tw, "NUMBER\tVALUE\tCOMMENT")
+		for _, v := range d.Values {
+			fmt.Fprintf(tw, "%v\t%v\t%v\n", v.Number, v.Name, firstLine(v.Comment))
+		}
+	case "service":
+		fmt.Fprintln(tw, "METHOD\tCOMMENT")
+		for _, m := range d.Methods {
+			fmt.Fprintf(tw, "%v\t%v\n", signature(m), firstLine(m.Comment))
+		}
+	}
+	tw.Flush()
+
+	if d.Skeleton != nil {
+		var skeleton bytes.Buffer
+		if err := json.Indent(&skeleton, d.Skeleton, "", "  "); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\nJSON:\n%v\n", skeleton.String())
+	}
+	return nil
+}
+
+func signature(m server.Method) string {
+	stream := func(streaming bool) string {
+		if streaming {
+			return "stream "
+		}
+		return ""
+	}
+	return fmt.Sprintf("%v(%v%v) returns (%v%v)", m.Name, stream(m.ClientStreaming), m.Input, stream(m.ServerStreaming), m.Output)
+}
+
+func commentLines(comment string) string {
+	lines := strings.Split(comment, "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight("// "+strings.TrimSpace(l), " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// firstLine shortens comments to fit in a table row.
+func firstLine(comment string) string {
+	return strings.TrimSpace(strings.SplitN(comment, "\n", 2)[0])
+}
+
+func printJSON(command *cobra.Command, v interface{}) error {
+	enc := json.NewEncoder(command.OutOrStdout())
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
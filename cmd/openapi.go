@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+)
+
+var openAPICmd = &cobra.Command{
+	Use:   "openapi PROTO_FILES",
+	Short: "Generate an OpenAPI document for the proxied endpoints",
+	Long:  "Generate an OpenAPI 3 document of the JSON requests and responses of the endpoints bound with google.api.http options or --route.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  openAPICmdFunc,
+}
+
+func init() {
+	openAPICmd.Flags().StringVarP(&outputFile, "output", "o", "", "write the document to this file instead of stdout")
+	openAPICmd.Flags().StringVar(&apiTitle, "title", "Protoxy", "title of the API")
+	openAPICmd.Flags().StringVar(&apiVersion, "api-version", "1.0.0", "version of the API")
+	openAPICmd.Flags().StringSliceVar(&apiServers, "server", nil, "base URL of the upstream API")
+	openAPICmd.Flags().StringArrayVar(&routes, "route", nil, "endpoint to document, given as 'METHOD PATH=TARGET' where TARGET is a method such as example.Library.GetBook or a REQUEST:RESPONSE pair of messages")
+}
+
+// Flags
+var apiTitle string
+var apiVersion string
+var apiServers []string
+var routes []string
+
+func openAPICmdFunc(command *cobra.Command, protoFiles []string) error {
+	opts := server.OpenAPIOptions{Title: apiTitle, Version: apiVersion, Servers: apiServers}
+	for _, r := range routes {
+		route, err := server.ParseRoute(r)
+		if err != nil {
+			return err
+		}
+		opts.Routes = append(opts.Routes, route)
+	}
+
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	doc, err := server.New(cfg).OpenAPI(opts)
+	if err != nil {
+		return err
+	}
+	if outputFile != "" {
+		return ioutil.WriteFile(outputFile, doc, 0644)
+	}
+	_, err = command.OutOrStdout().Write(doc)
+	return err
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/camgraff/protoxy/server"
+	"github.com/spf13/cobra"
+)
+
+var postmanCmd = &cobra.Command{
+	Use:   "postman",
+	Short: "Work with Postman collections",
+}
+
+var postmanExportCmd = &cobra.Command{
+	Use:   "export PROTO_FILES",
+	Short: "Generate a Postman collection for the services in proto files",
+	Long:  "Generate a Postman v2.1 collection with a request for each method of the services in proto files. Requests are sent through Protoxy with the Content-Type params and a sample JSON body already filled in.",
+	Args:  cobra.ArbitraryArgs,
+	RunE:  postmanExportCmdFunc,
+}
+
+func init() {
+	postmanCmd.AddCommand(postmanExportCmd)
+	postmanExportCmd.Flags().StringVarP(&outputFile, "output", "o", "", "write the collection to this file instead of stdout")
+	postmanExportCmd.Flags().StringVar(&collectionName, "name", "Protoxy", "name of the collection")
+	postmanExportCmd.Flags().StringVar(&baseURL, "base-url", "http://localhost:8080", "default value of the baseUrl variable that request URLs start with")
+	postmanExportCmd.Flags().StringVar(&proxyHost, "proxy-host", "localhost", "host Protoxy is listening on. The port is taken from --port")
+}
+
+// Flags
+var outputFile string
+var collectionName string
+var baseURL string
+var proxyHost string
+
+func postmanExportCmdFunc(command *cobra.Command, protoFiles []string) error {
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	collection, err := server.New(cfg).PostmanCollection(server.PostmanOptions{
+		Name:      collectionName,
+		BaseURL:   baseURL,
+		ProxyHost: proxyHost,
+		ProxyPort: port,
+	})
+	if err != nil {
+		return err
+	}
+	if outputFile != "" {
+		return ioutil.WriteFile(outputFile, collection, 0644)
+	}
+	_, err = command.OutOrStdout().Write(collection)
+	return err
+}
@@ -4,26 +4,104 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
+	"github.com/camgraff/protoxy/log"
+	"github.com/camgraff/protoxy/server"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 func init() {
+	rootCmd.AddCommand(startCmd, encodeCmd, decodeCmd, listCmd, describeCmd, postmanCmd, openAPICmd, callCmd)
 	rootCmd.PersistentFlags().StringSliceVarP(&importPaths, "import-paths", "I", nil, "paths to search for imports declared in your proto files. Defaults to current directory.")
 	rootCmd.MarkPersistentFlagRequired("proto")
 	rootCmd.PersistentFlags().Uint16Var(&port, "port", 7777, "the port to start the server on")
+	rootCmd.PersistentFlags().BoolVar(&rawFallback, "raw-fallback", false, "decode bodies without a schema when no message type is given or none match")
+	rootCmd.PersistentFlags().BoolVar(&fillDefaults, "fill-defaults", false, "send unset proto2 fields with their declared default values")
+	rootCmd.PersistentFlags().StringToStringVar(&respHeaders, "resp-header", nil, "decode a base64 protobuf response header or trailer to JSON, given as HEADER=MESSAGE_TYPE")
+	rootCmd.PersistentFlags().BoolVar(&decodedHeaderCopies, "decoded-header-copies", false, "keep decoded response headers as-is and add the JSON under X-Protoxy-Decoded-<name>")
+	rootCmd.PersistentFlags().BoolVar(&validate, "validate", false, "reject requests that violate protoc-gen-validate or protovalidate rules")
+	addUpstreamFlags(rootCmd.PersistentFlags(), &transport, defaultTransport)
+	rootCmd.PersistentFlags().DurationVar(&transport.IdleConnTimeout, "idle-conn-timeout", 90*time.Second, "how long idle upstream connections are kept open")
+	rootCmd.PersistentFlags().IntVar(&transport.MaxIdleConns, "max-idle-conns", 100, "maximum number of idle upstream connections")
+	rootCmd.PersistentFlags().IntVar(&transport.MaxIdleConnsPerHost, "max-idle-conns-per-host", 2, "maximum number of idle connections per upstream host")
+	rootCmd.PersistentFlags().IntVar(&transport.MaxConnsPerHost, "max-conns-per-host", 0, "maximum number of connections per upstream host. 0 means no limit")
+	rootCmd.PersistentFlags().Int64Var(&maxRequestBytes, "max-request-bytes", 0, "largest request body in bytes that is converted. 0 means no limit")
+	rootCmd.PersistentFlags().Int64Var(&maxResponseBytes, "max-response-bytes", 0, "largest response body in bytes that is converted. 0 means no limit")
+	rootCmd.PersistentFlags().BoolVar(&passLargeBodies, "pass-large-bodies", false, "forward bodies over the size limits unconverted instead of failing with a 413 or 502")
+	rootCmd.PersistentFlags().StringVar(&traceExporter, "trace-exporter", traceExporterNone, "where to export OpenTelemetry traces: none, otlp or file")
+	rootCmd.PersistentFlags().StringVar(&traceEndpoint, "trace-endpoint", "", "OTLP/HTTP endpoint URL for traces. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "info", "minimum level of log entries: trace, debug, info, warning, error, fatal or panic")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "format of log entries: text or json")
+	rootCmd.PersistentFlags().BoolVar(&logPayloads, "log-payloads", false, "log decoded request and response payloads at debug level, with redacted fields masked")
+	rootCmd.PersistentFlags().StringSliceVar(&redactOptions, "redact-option", nil, "custom bool field option, such as acme.sensitive, that marks fields to mask in logged payloads")
+	rootCmd.PersistentFlags().StringSliceVar(&redactFields, "redact-field", nil, "fully-qualified field, such as example.Login.password, to mask in logged payloads")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace-file", "protoxy-traces.json", "file to write traces to with --trace-exporter=file")
+	rootCmd.PersistentFlags().StringVar(&bufWorkspace, "buf", "", "buf.work.yaml, buf.yaml, or directory with one, to load protos and import paths from. Defaults to the current directory when no proto files or import paths are given")
+	rootCmd.PersistentFlags().StringVar(&bufVendor, "buf-vendor", "vendor", "directory with Buf dependencies laid out as REMOTE/OWNER/REPOSITORY, relative to the Buf workspace")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "settings file to read. Defaults to protoxy.yaml in the current directory, if it exists")
+}
+
+// defaultTransport holds the defaults of the flags added by addUpstreamFlags.
+var defaultTransport = server.TransportConfig{
+	DialTimeout:         30 * time.Second,
+	TLSHandshakeTimeout: 10 * time.Second,
+	RetryBackoff:        100 * time.Millisecond,
+}
+
+// addUpstreamFlags adds the flags for the transport settings that can also be set per upstream in the config file.
+func addUpstreamFlags(flags *pflag.FlagSet, cfg *server.TransportConfig, defaults server.TransportConfig) {
+	flags.DurationVar(&cfg.DialTimeout, "dial-timeout", defaults.DialTimeout, "timeout for connecting to upstreams")
+	flags.DurationVar(&cfg.TLSHandshakeTimeout, "tls-handshake-timeout", defaults.TLSHandshakeTimeout, "timeout for TLS handshakes with upstreams")
+	flags.DurationVar(&cfg.ResponseHeaderTimeout, "response-header-timeout", defaults.ResponseHeaderTimeout, "timeout for waiting on upstream response headers. 0 means no timeout")
+	flags.IntVar(&cfg.Retries, "retries", defaults.Retries, "number of times to retry idempotent requests after a connection error")
+	flags.DurationVar(&cfg.RetryBackoff, "retry-backoff", defaults.RetryBackoff, "delay before the first retry, doubled for each following retry")
+	flags.StringVar(&cfg.TLSCAFile, "tls-ca-file", defaults.TLSCAFile, "PEM file of certificate authorities to trust for upstreams, in addition to the system's")
+	flags.StringVar(&cfg.TLSCertFile, "tls-cert-file", defaults.TLSCertFile, "PEM client certificate for upstreams that require mutual TLS")
+	flags.StringVar(&cfg.TLSKeyFile, "tls-key-file", defaults.TLSKeyFile, "PEM key of --tls-cert-file")
+	flags.BoolVar(&cfg.TLSInsecureSkipVerify, "tls-insecure-skip-verify", defaults.TLSInsecureSkipVerify, "don't verify upstream certificates. Only use this for testing")
 }
 
 // Flags
 var importPaths []string
 var port uint16
+var rawFallback bool
+var fillDefaults bool
+var validate bool
+var respHeaders map[string]string
+var decodedHeaderCopies bool
+var transport server.TransportConfig
+var maxRequestBytes int64
+var maxResponseBytes int64
+var passLargeBodies bool
+var traceExporter string
+var traceEndpoint string
+var traceFile string
+var logLevel string
+var logFormat string
+var logPayloads bool
+var redactOptions []string
+var redactFields []string
+var configFile string
+var bufWorkspace string
+var bufVendor string
 
 var rootCmd = cobra.Command{
 	Use:   "protoxy PROTO_FILES",
 	Short: "Start the proxy server",
 	Long:  "Start a proxy server that converts JSON request bodies to Protocol Buffers. See github.com/camgraff/protoxy for documentation",
-	Args:  cobra.MinimumNArgs(1),
-	RunE:  startCmdFunc,
+	Args:  cobra.ArbitraryArgs,
+	PersistentPreRunE: func(command *cobra.Command, _ []string) error {
+		if err := loadSettings(command); err != nil {
+			return err
+		}
+		if err := log.Configure(logLevel, logFormat); err != nil {
+			return fmt.Errorf("Invalid log flags: %w", err)
+		}
+		return nil
+	},
+	RunE: startCmdFunc,
 }
 
 // Execute executes the root command.
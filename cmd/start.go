@@ -1,29 +1,115 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/camgraff/protoxy/log"
 	"github.com/camgraff/protoxy/protoparser"
 	"github.com/camgraff/protoxy/server"
+	"github.com/jhump/protoreflect/desc"
 	"github.com/spf13/cobra"
 )
 
+// tracingShutdownTimeout is how long start waits for the remaining spans to be exported when it exits.
+const tracingShutdownTimeout = 5 * time.Second
+
 var startCmd = &cobra.Command{
-	Use:   "start",
+	Use:   "start PROTO_FILES",
 	Short: "Start the proxy server",
+	Args:  cobra.ArbitraryArgs,
 	RunE:  startCmdFunc,
 }
 
 func startCmdFunc(command *cobra.Command, protoFiles []string) error {
-	fd, err := protoparser.FileDescriptorsFromPaths(importPaths, protoFiles)
+	cfg, err := newServerConfig(protoFiles)
+	if err != nil {
+		return err
+	}
+	tp, shutdownTracing, err := newTracerProvider()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Log.WithError(err).Error("unable to shut down tracing")
+		}
+	}()
+	cfg.TracerProvider = tp
+
+	// Stop gracefully on SIGINT or SIGTERM, so that the spans of the last requests are exported
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return server.New(cfg).Serve(ctx)
+}
+
+// newServerConfig loads protoFiles, or the protos setting if none are given, and builds the server config from the
+// flags. With a Buf workspace, its files are loaded when no proto files are given.
+func newServerConfig(protoFiles []string) (server.Config, error) {
+	if len(protoFiles) == 0 {
+		protoFiles = protos
+	}
+	if _, err := transport.TLSConfig(); err != nil {
+		return server.Config{}, fmt.Errorf("Invalid TLS flags: %w", err)
+	}
+	for host, cfg := range upstreams {
+		if _, err := cfg.TLSConfig(); err != nil {
+			return server.Config{}, fmt.Errorf("Invalid TLS settings for upstream '%v': %w", host, err)
+		}
+	}
+	fd, err := loadProtoFiles(protoFiles)
 	if err != nil {
-		return fmt.Errorf("Invalid proto path: %w", err)
+		return server.Config{}, err
+	}
+	return server.Config{
+		FileDescriptors:     fd,
+		Port:                port,
+		RawFallback:         rawFallback,
+		FillDefaults:        fillDefaults,
+		Validate:            validate,
+		ResponseHeaders:     respHeaders,
+		DecodedHeaderCopies: decodedHeaderCopies,
+		Transport:           transport,
+		Upstreams:           upstreams,
+		MaxRequestBytes:     maxRequestBytes,
+		MaxResponseBytes:    maxResponseBytes,
+		PassLargeBodies:     passLargeBodies,
+		LogPayloads:         logPayloads,
+		RedactOptions:       redactOptions,
+		RedactFields:        redactFields,
+	}, nil
+}
+
+// loadProtoFiles parses protoFiles with the import paths from the flags and the Buf workspace, if any.
+func loadProtoFiles(protoFiles []string) ([]*desc.FileDescriptor, error) {
+	bufPath := bufWorkspace
+	if bufPath == "" && len(protoFiles) == 0 && len(importPaths) == 0 {
+		bufPath, _ = protoparser.FindBufWorkspace(".")
 	}
-	cfg := server.Config{
-		FileDescriptors: fd,
-		Port:            port,
+	if bufPath != "" {
+		ws, err := protoparser.LoadBufWorkspace(bufPath, bufVendor)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid buf workspace: %w", err)
+		}
+		fd, err := protoparser.FileDescriptorsFromBuf(ws, importPaths, protoFiles)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proto path: %w", err)
+		}
+		return fd, nil
+	}
+
+	if len(protoFiles) == 0 {
+		return nil, fmt.Errorf("No proto files given. Pass them as arguments, set protos in %v, or run from a buf workspace", defaultConfigFile)
+	}
+	fd, err := protoparser.FileDescriptorsFromPaths(importPaths, protoFiles)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proto path: %w", err)
 	}
-	srv := server.New(cfg)
-	srv.Run()
-	return nil
+	return fd, nil
 }
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Values of the --trace-exporter flag.
+const (
+	traceExporterNone = "none"
+	traceExporterOTLP = "otlp"
+	traceExporterFile = "file"
+)
+
+// newTracerProvider returns a provider that exports spans to the configured exporter, or nil if tracing is disabled.
+// The returned function flushes the spans that haven't been exported yet and releases the exporter, and must be called
+// once the provider is no longer used.
+func newTracerProvider() (trace.TracerProvider, func(context.Context) error, error) {
+	var opt sdktrace.TracerProviderOption
+	// Closes the trace file, if any, after the provider has shut down
+	closeFile := func() error { return nil }
+	switch traceExporter {
+	case "", traceExporterNone:
+		return nil, func(context.Context) error { return nil }, nil
+	case traceExporterOTLP:
+		var opts []otlptracehttp.Option
+		if traceEndpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(traceEndpoint))
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to create OTLP exporter: %w", err)
+		}
+		opt = sdktrace.WithBatcher(exporter)
+	case traceExporterFile:
+		f, err := os.OpenFile(traceFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Unable to open trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("Unable to create file exporter: %w", err)
+		}
+		opt = sdktrace.WithBatcher(exporter)
+		closeFile = f.Close
+	default:
+		return nil, nil, fmt.Errorf("Unknown trace exporter '%v'", traceExporter)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName("protoxy")))
+	if err != nil {
+		closeFile()
+		return nil, nil, fmt.Errorf("Unable to create trace resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(opt, sdktrace.WithResource(res))
+	shutdown := func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if closeErr := closeFile(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Unable to close trace file: %w", closeErr)
+		}
+		return err
+	}
+	return tp, shutdown, nil
+}
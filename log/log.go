@@ -1,6 +1,46 @@
 // Package log provides logging functionality
 package log
 
-import "github.com/sirupsen/logrus"
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
 
 var Log = logrus.New()
+
+// Configure sets the level and format of Log. The format is either text or json.
+func Configure(level string, format string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	Log.SetLevel(lvl)
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		Log.Formatter = &logrus.TextFormatter{}
+	case "json":
+		Log.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format '%v'", format)
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx that carries entry, so that everything logged for a request shares its fields.
+func NewContext(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the entry carried by ctx, or an entry of Log without fields if there is none.
+func FromContext(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(Log)
+}
@@ -0,0 +1,353 @@
+package protoparser
+
+import (
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/camgraff/protoxy/log"
+	"github.com/jhump/protoreflect/desc"
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the Buf config files.
+const (
+	bufWorkFile = "buf.work.yaml"
+	bufYAMLFile = "buf.yaml"
+	bufLockFile = "buf.lock"
+)
+
+// BufWorkspace is a Buf workspace or module. Its module roots are import paths for each other, and its dependencies
+// are found in a vendor directory or Buf's local module cache.
+type BufWorkspace struct {
+	// Dir is the directory of the buf.work.yaml or buf.yaml.
+	Dir string
+	// Roots are the module directories.
+	Roots []string
+	// Excludes are directories under Roots that are left out of the modules.
+	Excludes []string
+	// VendorDir is the directory that dependencies are looked up in before Buf's module cache.
+	VendorDir string
+	// Deps are the directories of the dependencies that were found.
+	Deps []string
+	// Missing are the names of the dependencies that were not found.
+	Missing []string
+}
+
+// bufWork is a buf.work.yaml file.
+type bufWork struct {
+	Version     string   `yaml:"version"`
+	Directories []string `yaml:"directories"`
+}
+
+// bufConfig is a buf.yaml file of any version. v1beta1 and v1 describe a single module, and v2 describes a workspace.
+type bufConfig struct {
+	Version string   `yaml:"version"`
+	Deps    []string `yaml:"deps"`
+	Build   struct {
+		Roots    []string `yaml:"roots"`
+		Excludes []string `yaml:"excludes"`
+	} `yaml:"build"`
+	Modules []struct {
+		Path     string   `yaml:"path"`
+		Excludes []string `yaml:"excludes"`
+	} `yaml:"modules"`
+}
+
+// bufLock is a buf.lock file. v1 names dependencies by remote, owner and repository, and v2 by their full name.
+type bufLock struct {
+	Deps []struct {
+		Remote     string `yaml:"remote"`
+		Owner      string `yaml:"owner"`
+		Repository string `yaml:"repository"`
+		Name       string `yaml:"name"`
+		Commit     string `yaml:"commit"`
+	} `yaml:"deps"`
+}
+
+// bufDep is a module dependency, such as buf.build/googleapis/googleapis. Commit is only known from a buf.lock.
+type bufDep struct {
+	name   string
+	commit string
+}
+
+// FindBufWorkspace returns the buf.work.yaml or buf.yaml in dir, if there is one.
+func FindBufWorkspace(dir string) (string, bool) {
+	for _, name := range []string{bufWorkFile, bufYAMLFile} {
+		if p := filepath.Join(dir, name); isFile(p) {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// LoadBufWorkspace reads the Buf workspace or module at path, which is a buf.work.yaml, a buf.yaml, or a directory
+// with one of them. Dependencies are looked up in vendorDir, relative to the workspace, then in Buf's module cache.
+func LoadBufWorkspace(path string, vendorDir string) (*BufWorkspace, error) {
+	if isDir(path) {
+		p, ok := FindBufWorkspace(path)
+		if !ok {
+			return nil, fmt.Errorf("No %v or %v in '%v'", bufWorkFile, bufYAMLFile, path)
+		}
+		path = p
+	}
+	ws := &BufWorkspace{Dir: filepath.Dir(path)}
+	var deps []bufDep
+
+	if filepath.Base(path) == bufWorkFile {
+		var work bufWork
+		if err := readYAML(path, &work); err != nil {
+			return nil, err
+		}
+		for _, dir := range work.Directories {
+			moduleDeps, err := ws.addModule(filepath.Join(ws.Dir, dir))
+			if err != nil {
+				return nil, err
+			}
+			deps = append(deps, moduleDeps...)
+		}
+	} else {
+		var cfg bufConfig
+		if err := readYAML(path, &cfg); err != nil {
+			return nil, err
+		}
+		if cfg.Version == "v2" {
+			if len(cfg.Modules) == 0 {
+				ws.Roots = []string{ws.Dir}
+			}
+			for _, m := range cfg.Modules {
+				ws.Roots = append(ws.Roots, filepath.Join(ws.Dir, m.Path))
+				for _, e := range m.Excludes {
+					ws.Excludes = append(ws.Excludes, filepath.Join(ws.Dir, e))
+				}
+			}
+			lockDeps, err := readBufLock(ws.Dir)
+			if err != nil {
+				return nil, err
+			}
+			deps = mergeDeps(cfg.Deps, lockDeps)
+		} else {
+			moduleDeps, err := ws.addModule(ws.Dir)
+			if err != nil {
+				return nil, err
+			}
+			deps = moduleDeps
+		}
+	}
+
+	if vendorDir != "" && !filepath.IsAbs(vendorDir) {
+		vendorDir = filepath.Join(ws.Dir, vendorDir)
+	}
+	ws.VendorDir = vendorDir
+	seen := map[string]bool{}
+	for _, dep := range deps {
+		if seen[dep.name] {
+			continue
+		}
+		seen[dep.name] = true
+		if dir, ok := findBufDep(dep, vendorDir); ok {
+			ws.Deps = append(ws.Deps, dir)
+			continue
+		}
+		log.Log.WithField("dependency", dep.name).Warn("buf dependency not found in the vendor directory or module cache")
+		ws.Missing = append(ws.Missing, dep.name)
+	}
+	return ws, nil
+}
+
+// addModule adds the roots and excludes of the v1 or v1beta1 module in dir, and returns its dependencies. A directory
+// of a buf.work.yaml doesn't need a buf.yaml.
+func (ws *BufWorkspace) addModule(dir string) ([]bufDep, error) {
+	var cfg bufConfig
+	if p := filepath.Join(dir, bufYAMLFile); isFile(p) {
+		if err := readYAML(p, &cfg); err != nil {
+			return nil, err
+		}
+	}
+	roots := cfg.Build.Roots
+	if len(roots) == 0 {
+		roots = []string{"."}
+	}
+	for _, root := range roots {
+		ws.Roots = append(ws.Roots, filepath.Join(dir, root))
+		for _, e := range cfg.Build.Excludes {
+			// Excludes are relative to the module, or to the root in v1beta1
+			if cfg.Version == "v1beta1" {
+				e = filepath.Join(root, e)
+			}
+			ws.Excludes = append(ws.Excludes, filepath.Join(dir, e))
+		}
+	}
+	lockDeps, err := readBufLock(dir)
+	if err != nil {
+		return nil, err
+	}
+	return mergeDeps(cfg.Deps, lockDeps), nil
+}
+
+// ImportPaths returns the module roots followed by the dependency directories.
+func (ws *BufWorkspace) ImportPaths() []string {
+	return append(append([]string{}, ws.Roots...), ws.Deps...)
+}
+
+// Files returns the names of the .proto files of the workspace's modules, relative to their root. The vendor and
+// dependency directories are left out even if they are under a root, since their files are loaded through imports.
+func (ws *BufWorkspace) Files() ([]string, error) {
+	excluded := map[string]bool{}
+	for _, e := range append(append([]string{ws.VendorDir}, ws.Excludes...), ws.Deps...) {
+		if e != "" {
+			excluded[filepath.Clean(e)] = true
+		}
+	}
+	var names []string
+	for _, root := range ws.Roots {
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if excluded[filepath.Clean(p)] || (p != root && strings.HasPrefix(d.Name(), ".")) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(p, ".proto") {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Unable to search for proto files in '%v': %w", root, err)
+		}
+	}
+	return names, nil
+}
+
+// FileDescriptorsFromBuf loads protoFiles, or every file of ws if there are none, with the roots and dependencies of
+// ws added before importPaths. Files of ws that fail to parse, or conflict with each other, are skipped with a
+// warning.
+func FileDescriptorsFromBuf(ws *BufWorkspace, importPaths []string, protoFiles []string) ([]*desc.FileDescriptor, error) {
+	paths := append(ws.ImportPaths(), importPaths...)
+	if len(protoFiles) > 0 {
+		return FileDescriptorsFromPaths(paths, protoFiles)
+	}
+	names, err := ws.Files()
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("No .proto files in the buf workspace at '%v'", ws.Dir)
+	}
+	discovered := map[string]bool{}
+	for _, name := range names {
+		discovered[name] = true
+	}
+	return parseFiles(paths, names, discovered)
+}
+
+// findBufDep returns the directory of dep in vendorDir or Buf's module cache.
+func findBufDep(dep bufDep, vendorDir string) (string, bool) {
+	parts := strings.Split(dep.name, "/")
+	if len(parts) != 3 {
+		return "", false
+	}
+	remote, owner, repo := parts[0], parts[1], parts[2]
+	if vendorDir != "" {
+		for _, dir := range []string{
+			filepath.Join(vendorDir, remote, owner, repo),
+			filepath.Join(vendorDir, owner, repo),
+		} {
+			if isDir(dir) {
+				return dir, true
+			}
+		}
+	}
+	if dep.commit == "" {
+		return "", false
+	}
+
+	// The layout of the cache changed between versions of Buf
+	cache := bufCacheDir()
+	for _, pattern := range []string{
+		filepath.Join(cache, "v3", "modules", "*", remote, owner, repo, dep.commit, "files"),
+		filepath.Join(cache, "v2", "module", "*", remote, owner, repo, dep.commit, "files"),
+		filepath.Join(cache, "v1", "module", "data", remote, owner, repo, dep.commit),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			if isDir(m) {
+				return m, true
+			}
+		}
+	}
+	return "", false
+}
+
+// bufCacheDir returns the directory of Buf's module cache.
+func bufCacheDir() string {
+	if dir := os.Getenv("BUF_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "buf")
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".cache", "buf")
+}
+
+// readBufLock returns the dependencies pinned in the buf.lock in dir, if there is one.
+func readBufLock(dir string) ([]bufDep, error) {
+	p := filepath.Join(dir, bufLockFile)
+	if !isFile(p) {
+		return nil, nil
+	}
+	var lock bufLock
+	if err := readYAML(p, &lock); err != nil {
+		return nil, err
+	}
+	var deps []bufDep
+	for _, d := range lock.Deps {
+		name := d.Name
+		if name == "" {
+			name = strings.Join([]string{d.Remote, d.Owner, d.Repository}, "/")
+		}
+		deps = append(deps, bufDep{name: name, commit: d.Commit})
+	}
+	return deps, nil
+}
+
+// mergeDeps returns the dependencies in lockDeps, followed by those in names that aren't locked. Names may end with a
+// :reference, which is ignored.
+func mergeDeps(names []string, lockDeps []bufDep) []bufDep {
+	deps := append([]bufDep{}, lockDeps...)
+	locked := map[string]bool{}
+	for _, d := range lockDeps {
+		locked[d.name] = true
+	}
+	for _, name := range names {
+		name = strings.SplitN(name, ":", 2)[0]
+		if !locked[name] {
+			deps = append(deps, bufDep{name: name})
+		}
+	}
+	return deps
+}
+
+func readYAML(path string, v interface{}) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read %v: %w", path, err)
+	}
+	if err := yaml.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("Invalid %v: %w", path, err)
+	}
+	return nil
+}
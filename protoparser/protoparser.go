@@ -2,21 +2,326 @@
 package protoparser
 
 import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
 	"github.com/camgraff/protoxy/log"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/desc/protoparse"
+
+	// Link in the well-known types so their descriptors are always available.
+	_ "github.com/golang/protobuf/ptypes/any"
+	_ "github.com/golang/protobuf/ptypes/duration"
+	_ "github.com/golang/protobuf/ptypes/empty"
+	_ "github.com/golang/protobuf/ptypes/struct"
+	_ "github.com/golang/protobuf/ptypes/timestamp"
+	_ "github.com/golang/protobuf/ptypes/wrappers"
+	_ "google.golang.org/genproto/protobuf/field_mask"
 )
 
+// wellKnownFiles are the well-known type protos that are built into protoxy.
+var wellKnownFiles = []string{
+	"google/protobuf/any.proto",
+	"google/protobuf/duration.proto",
+	"google/protobuf/empty.proto",
+	"google/protobuf/field_mask.proto",
+	"google/protobuf/struct.proto",
+	"google/protobuf/timestamp.proto",
+	"google/protobuf/wrappers.proto",
+}
+
 // FileDescriptorsFromPaths loads the file descriptors for each .proto file in protoFiles.
-// It attempts to infer imports in the .proto files from the file paths in importPaths
+// It attempts to infer imports in the .proto files from the file paths in importPaths.
+// Entries of protoFiles may also be directories, which are searched recursively, or glob patterns such as
+// protos/**/*.proto. Files found this way that fail to parse or conflict with other files are skipped with a warning.
 func FileDescriptorsFromPaths(importPaths []string, protoFiles []string) ([]*desc.FileDescriptor, error) {
+	names, discovered, err := ResolveProtoFiles(importPaths, protoFiles)
+	if err != nil {
+		log.Log.WithError(err).Error("error finding proto files")
+		return nil, err
+	}
+	return parseFiles(importPaths, names, discovered)
+}
+
+// parseFiles parses the files with the given import-relative names. Files in discovered that fail to parse, or
+// conflict with the other files, are skipped with a warning.
+func parseFiles(importPaths []string, names []string, discovered map[string]bool) ([]*desc.FileDescriptor, error) {
 	parser := protoparse.Parser{
 		ImportPaths: importPaths,
+		// Keep comments so they can be shown by the describe command
+		IncludeSourceCodeInfo: true,
 	}
-	descriptors, err := parser.ParseFiles(protoFiles...)
-	if err != nil {
+	descriptors, err := parser.ParseFiles(names...)
+	if err == nil {
+		return descriptors, nil
+	}
+	if len(discovered) == 0 {
 		log.Log.WithError(err).Error("error parsing proto files")
 		return nil, err
 	}
-	return descriptors, nil
+
+	// Find the files that fail on their own, and load the rest without them
+	var valid []string
+	for _, name := range names {
+		if _, fileErr := parser.ParseFiles(name); fileErr != nil {
+			if !discovered[name] {
+				log.Log.WithError(fileErr).Error("error parsing proto files")
+				return nil, fileErr
+			}
+			log.Log.WithError(fileErr).WithField("file", name).Warn("skipping proto file that failed to parse")
+			continue
+		}
+		valid = append(valid, name)
+	}
+	// Files can also conflict with each other, such as by defining the same symbols. Leave out discovered files one at
+	// a time until the rest load together.
+	for len(valid) > 0 {
+		descriptors, err = parser.ParseFiles(valid...)
+		if err == nil {
+			return descriptors, nil
+		}
+		conflict := conflictingFile(parser, err, valid, discovered)
+		if conflict == "" {
+			log.Log.WithError(err).Error("error parsing proto files")
+			return nil, err
+		}
+		log.Log.WithError(err).WithField("file", conflict).Warn("skipping proto file that conflicts with other files")
+		var rest []string
+		for _, name := range valid {
+			if name != conflict {
+				rest = append(rest, name)
+			}
+		}
+		valid = rest
+	}
+	return nil, fmt.Errorf("No proto files could be parsed: %w", err)
+}
+
+// conflictingFile returns the discovered file among names to leave out after they failed to parse together with
+// err, or "" if there is none. The file err is in conflicts with itself and each file that fails to parse along with
+// it, and the last of them that was discovered is left out. protoparse reports whichever file it reaches first, so
+// the choice doesn't depend on that.
+func conflictingFile(parser protoparse.Parser, err error, names []string, discovered map[string]bool) string {
+	var posErr protoparse.ErrorWithPos
+	if !errors.As(err, &posErr) {
+		return ""
+	}
+	file := posErr.GetPosition().Filename
+	conflict := ""
+	for _, name := range names {
+		if !discovered[name] {
+			continue
+		}
+		if name == file {
+			conflict = name
+		} else if _, err := parser.ParseFiles(file, name); err != nil {
+			conflict = name
+		}
+	}
+	return conflict
+}
+
+// ResolveProtoFiles expands the directories and glob patterns in protoFiles to the .proto files they contain, and
+// returns the names of all the files relative to the import path they are under, as protoparse expects them.
+// Patterns may use ** to match any number of directories. Directories and patterns are looked up from the current
+// directory, then from each import path. Names that are neither are returned unchanged. The files that came from a
+// directory or pattern are also returned as a set.
+func ResolveProtoFiles(importPaths []string, protoFiles []string) ([]string, map[string]bool, error) {
+	if len(importPaths) == 0 {
+		importPaths = []string{"."}
+	}
+	var names []string
+	discovered := map[string]bool{}
+	seen := map[string]bool{}
+	add := func(name string, found bool) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		names = append(names, name)
+		if found {
+			discovered[name] = true
+		}
+	}
+
+	for _, pattern := range protoFiles {
+		// Look the pattern up from the current directory, then from the import paths
+		bases := append([]string{""}, importPaths...)
+		if filepath.IsAbs(pattern) {
+			bases = []string{""}
+		}
+		dir := false
+		for _, base := range bases {
+			dir = dir || isDir(filepath.Join(base, pattern))
+		}
+		if !isPattern(pattern) && !dir {
+			name := filepath.ToSlash(pattern)
+			if !underImportPath(importPaths, pattern) && isFile(pattern) {
+				var err error
+				if name, err = importName(importPaths, pattern); err != nil {
+					return nil, nil, err
+				}
+			}
+			add(name, false)
+			continue
+		}
+
+		var files []string
+		for _, base := range bases {
+			var err error
+			files, err = findProtoFiles(filepath.Join(base, pattern))
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(files) > 0 {
+				break
+			}
+		}
+		if len(files) == 0 {
+			return nil, nil, fmt.Errorf("No .proto files match '%v'", pattern)
+		}
+		for _, f := range files {
+			name, err := importName(importPaths, f)
+			if err != nil {
+				return nil, nil, err
+			}
+			add(name, true)
+		}
+	}
+	return names, discovered, nil
+}
+
+// underImportPath reports whether name is already the name of a file relative to one of the import paths.
+func underImportPath(importPaths []string, name string) bool {
+	if filepath.IsAbs(name) {
+		return false
+	}
+	for _, ip := range importPaths {
+		if isFile(filepath.Join(ip, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// importName returns the name of file relative to the first import path it is under.
+func importName(importPaths []string, file string) (string, error) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", err
+	}
+	for _, ip := range importPaths {
+		absIP, err := filepath.Abs(ip)
+		if err != nil {
+			return "", err
+		}
+		rel, err := filepath.Rel(absIP, abs)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel), nil
+		}
+	}
+	return "", fmt.Errorf("Proto file '%v' is not under any import path: %v", file, importPaths)
+}
+
+// findProtoFiles returns the .proto files in the directory dir, or the files matching the glob pattern.
+func findProtoFiles(pattern string) ([]string, error) {
+	// Walk from the deepest directory without wildcards
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	i := 0
+	for i < len(segments) && !isPattern(segments[i]) {
+		i++
+	}
+	root := filepath.FromSlash(strings.Join(segments[:i], "/"))
+	if i > 0 && root == "" {
+		root = string(filepath.Separator)
+	}
+	match := segments[i:]
+	if len(match) == 0 {
+		// A directory matches every .proto file under it
+		match = []string{"**", "*.proto"}
+	}
+	if root == "" {
+		root = "."
+	}
+	if !isDir(root) {
+		return nil, nil
+	}
+
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(p, ".proto") && matchSegments(match, strings.Split(filepath.ToSlash(rel), "/")) {
+			files = append(files, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to search for proto files: %w", err)
+	}
+	return files, nil
+}
+
+// matchSegments reports whether the path segments match the pattern segments, where ** matches any number of
+// segments and the others are matched with path.Match.
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	ok, err := path.Match(pattern[0], segments[0])
+	return err == nil && ok && matchSegments(pattern[1:], segments[1:])
+}
+
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func isDir(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && info.IsDir()
+}
+
+func isFile(p string) bool {
+	info, err := os.Stat(p)
+	return err == nil && !info.IsDir()
+}
+
+// WellKnownTypes returns the file descriptors for the built-in copy of the well-known type protos.
+func WellKnownTypes() ([]*desc.FileDescriptor, error) {
+	var fds []*desc.FileDescriptor
+	for _, name := range wellKnownFiles {
+		fd, err := desc.LoadFileDescriptor(name)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	return fds, nil
 }
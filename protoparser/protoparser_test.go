@@ -0,0 +1,213 @@
+package protoparser
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/camgraff/protoxy/log"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileDescriptorsFromPaths(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"example/good.proto":          `syntax = "proto3"; package example; message Good {}`,
+		"example/nested/nested.proto": `syntax = "proto3"; package example.nested; import "example/good.proto"; message Nested { example.Good good = 1; }`,
+		"example/bad.proto":           `syntax = "proto3"; message Bad {`,
+		".hidden/hidden.proto":        `syntax = "proto3"; message Hidden {}`,
+		"example/README.md":           `not a proto`,
+		"p/a.proto":                   `syntax = "proto3"; package x; message Foo {}`,
+		"p/b.proto":                   `syntax = "proto3"; package x; message Foo {}`,
+		"p/c.proto":                   `syntax = "proto3"; package x; message Bar {}`,
+	}
+	for name, content := range files {
+		p := filepath.Join(root, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+
+	tests := []struct {
+		name       string
+		protoFiles []string
+		expected   []string
+		err        bool
+	}{
+		{
+			name:       "import-relative name",
+			protoFiles: []string{"example/good.proto"},
+			expected:   []string{"example/good.proto"},
+		},
+		{
+			name:       "path from the current directory",
+			protoFiles: []string{filepath.Join(root, "example/nested/nested.proto")},
+			expected:   []string{"example/nested/nested.proto"},
+		},
+		{
+			name:       "glob skips files that fail to parse",
+			protoFiles: []string{filepath.Join(root, "**/*.proto")},
+			expected:   []string{"example/good.proto", "example/nested/nested.proto", "p/a.proto", "p/c.proto"},
+		},
+		{
+			name:       "glob from the import path",
+			protoFiles: []string{"example/*/*.proto"},
+			expected:   []string{"example/nested/nested.proto"},
+		},
+		{
+			name:       "directory",
+			protoFiles: []string{"example/nested", "example/good.proto"},
+			expected:   []string{"example/nested/nested.proto", "example/good.proto"},
+		},
+		{
+			name:       "glob skips files that conflict",
+			protoFiles: []string{"p/*.proto"},
+			expected:   []string{"p/a.proto", "p/c.proto"},
+		},
+		{
+			name:       "named file wins over a conflicting discovered file",
+			protoFiles: []string{"p/b.proto", "p"},
+			expected:   []string{"p/b.proto", "p/c.proto"},
+		},
+		{
+			name:       "named files that conflict",
+			protoFiles: []string{"p/a.proto", "p/b.proto"},
+			err:        true,
+		},
+		{
+			name:       "named file that fails to parse",
+			protoFiles: []string{"example/good.proto", "example/bad.proto"},
+			err:        true,
+		},
+		{
+			name:       "no matches",
+			protoFiles: []string{"missing/**/*.proto"},
+			err:        true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fds, err := FileDescriptorsFromPaths([]string{root}, tc.protoFiles)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			var names []string
+			for _, fd := range fds {
+				names = append(names, fd.GetName())
+			}
+			assert.Equal(t, tc.expected, names)
+		})
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern  []string
+		path     []string
+		expected bool
+	}{
+		{[]string{"*.proto"}, []string{"a.proto"}, true},
+		{[]string{"*.proto"}, []string{"a", "b.proto"}, false},
+		{[]string{"**", "*.proto"}, []string{"a.proto"}, true},
+		{[]string{"**", "*.proto"}, []string{"a", "b", "c.proto"}, true},
+		{[]string{"a", "**", "c", "*.proto"}, []string{"a", "c", "d.proto"}, true},
+		{[]string{"a", "**", "c", "*.proto"}, []string{"a", "b", "d.proto"}, false},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, matchSegments(tc.pattern, tc.path), "%v %v", tc.pattern, tc.path)
+	}
+}
+
+func TestBufWorkspace(t *testing.T) {
+	writeFiles := func(root string, files map[string]string) {
+		for name, content := range files {
+			p := filepath.Join(root, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+		}
+	}
+	depProto := `syntax = "proto3"; package acme.types; message Money { int64 units = 1; }`
+
+	t.Run("v1 workspace with cached dependency", func(t *testing.T) {
+		cache := t.TempDir()
+		t.Setenv("BUF_CACHE_DIR", cache)
+		writeFiles(cache, map[string]string{
+			"v1/module/data/buf.build/acme/types/abc123/acme/types/money.proto": depProto,
+		})
+		root := t.TempDir()
+		writeFiles(root, map[string]string{
+			"buf.work.yaml":            "version: v1\ndirectories:\n  - proto\n  - shared\n",
+			"proto/buf.yaml":           "version: v1\ndeps:\n  - buf.build/acme/types\n  - buf.build/acme/missing\nbuild:\n  excludes:\n    - tmp\n",
+			"proto/buf.lock":           "version: v1\ndeps:\n  - remote: buf.build\n    owner: acme\n    repository: types\n    commit: abc123\n",
+			"proto/shop/v1/shop.proto": `syntax = "proto3"; package shop.v1; import "acme/types/money.proto"; import "common/id.proto"; message Order { common.Id id = 1; acme.types.Money total = 2; }`,
+			"proto/tmp/scratch.proto":  `syntax = "proto3"; message Scratch {}`,
+			"shared/common/id.proto":   `syntax = "proto3"; package common; message Id { string value = 1; }`,
+		})
+
+		ws, err := LoadBufWorkspace(root, "vendor")
+		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(root, "proto"), filepath.Join(root, "shared")}, ws.Roots)
+		assert.Equal(t, []string{filepath.Join(cache, "v1/module/data/buf.build/acme/types/abc123")}, ws.Deps)
+		assert.Equal(t, []string{"buf.build/acme/missing"}, ws.Missing)
+
+		fds, err := FileDescriptorsFromBuf(ws, nil, nil)
+		require.NoError(t, err)
+		var names []string
+		for _, fd := range fds {
+			names = append(names, fd.GetName())
+		}
+		assert.Equal(t, []string{"shop/v1/shop.proto", "common/id.proto"}, names)
+	})
+
+	t.Run("v1 module with vendored dependency", func(t *testing.T) {
+		t.Setenv("BUF_CACHE_DIR", t.TempDir())
+		root := t.TempDir()
+		writeFiles(root, map[string]string{
+			"buf.yaml": "version: v1\ndeps:\n  - buf.build/acme/types\n",
+			"vendor/buf.build/acme/types/acme/types/money.proto": depProto,
+			"shop/v1/shop.proto": `syntax = "proto3"; package shop.v1; import "acme/types/money.proto"; message Order { acme.types.Money total = 1; }`,
+		})
+		hook := logtest.NewLocal(log.Log)
+		defer hook.Reset()
+
+		ws, err := LoadBufWorkspace(root, "vendor")
+		require.NoError(t, err)
+		fds, err := FileDescriptorsFromBuf(ws, nil, nil)
+		require.NoError(t, err)
+		require.Len(t, fds, 1)
+		assert.Equal(t, "shop/v1/shop.proto", fds[0].GetName())
+		assert.Empty(t, hook.AllEntries(), "vendored files should not be loaded as workspace files")
+	})
+
+	t.Run("v2 workspace with vendored dependency", func(t *testing.T) {
+		t.Setenv("BUF_CACHE_DIR", t.TempDir())
+		root := t.TempDir()
+		writeFiles(root, map[string]string{
+			"buf.yaml": "version: v2\nmodules:\n  - path: proto\n    excludes:\n      - proto/internal\ndeps:\n  - buf.build/acme/types\n",
+			"buf.lock": "version: v2\ndeps:\n  - name: buf.build/acme/types\n    commit: def456\n",
+			"third_party/buf.build/acme/types/acme/types/money.proto": depProto,
+			"proto/shop/v1/shop.proto":                                `syntax = "proto3"; package shop.v1; import "acme/types/money.proto"; message Order { acme.types.Money total = 1; }`,
+			"proto/internal/internal.proto":                           `syntax = "proto3"; message Internal {}`,
+		})
+
+		ws, err := LoadBufWorkspace(filepath.Join(root, "buf.yaml"), "third_party")
+		require.NoError(t, err)
+		assert.Empty(t, ws.Missing)
+
+		fds, err := FileDescriptorsFromBuf(ws, nil, nil)
+		require.NoError(t, err)
+		require.Len(t, fds, 1)
+		assert.Equal(t, "shop/v1/shop.proto", fds[0].GetName())
+
+		// Named files are loaded instead of the whole workspace
+		fds, err = FileDescriptorsFromBuf(ws, nil, []string{"internal/internal.proto"})
+		require.NoError(t, err)
+		require.Len(t, fds, 1)
+		assert.Equal(t, "internal/internal.proto", fds[0].GetName())
+	})
+}
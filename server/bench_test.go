@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// BenchmarkProxyRequest compares sharing one ReverseProxy across requests with building a new one for every request.
+// Both use the server's connection pool.
+func BenchmarkProxyRequest(b *testing.B) {
+	resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+	require.NoError(b, err)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(resp)
+	}))
+	defer backend.Close()
+
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(b, err)
+
+	send := func(b *testing.B, srv *Server) {
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"some text","number":123}`))
+		req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+		respRecorder := httptest.NewRecorder()
+		srv.proxyRequest(respRecorder, req)
+		if respRecorder.Code != http.StatusOK {
+			b.Fatalf("unexpected status %v", respRecorder.Code)
+		}
+	}
+
+	srv := New(Config{FileDescriptors: fds})
+
+	b.Run("shared", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				send(b, srv)
+			}
+		})
+	})
+
+	b.Run("per request", func(b *testing.B) {
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				perRequest := *srv
+				perRequest.proxy = perRequest.newReverseProxy()
+				send(b, &perRequest)
+			}
+		})
+	})
+}
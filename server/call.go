@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// errServerClosed is returned by Server.Call once the server is closed.
+var errServerClosed = errors.New("Protoxy server is closed")
+
+// caller serves the requests of Server.Call on a loopback listener, which is started by the first call.
+type caller struct {
+	once      sync.Once
+	server    *http.Server
+	transport *callTransport
+	err       error
+}
+
+// Call converts and sends r the same way as a proxied request, and returns the response the client would get. r.URL
+// must be absolute, and r carries the Content-Type params for its message types like any other request. The request
+// is sent to s.Handler() over a loopback connection, so the response is read off the wire like any other. The
+// listener is stopped by Close.
+func (s *Server) Call(r *http.Request) (*http.Response, error) {
+	if !r.URL.IsAbs() {
+		return nil, fmt.Errorf("URL '%v' must be absolute", r.URL)
+	}
+	s.caller.once.Do(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			s.caller.err = fmt.Errorf("Unable to listen for calls: %w", err)
+			return
+		}
+		s.caller.server = &http.Server{Handler: s.Handler()}
+		s.caller.transport = &callTransport{addr: l.Addr().String()}
+		go s.caller.server.Serve(l)
+	})
+	if s.caller.err != nil {
+		return nil, s.caller.err
+	}
+	client := &http.Client{
+		Transport: s.caller.transport,
+		// Redirects are returned to the caller, as they are by the proxy
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return client.Do(r)
+}
+
+// Close stops the listener started by Call and closes the idle connections to it and to upstreams. Calls fail once
+// the server is closed.
+func (s *Server) Close() error {
+	s.caller.once.Do(func() {
+		s.caller.err = errServerClosed
+	})
+	s.transport.closeIdleConnections()
+	if s.caller.server == nil {
+		return nil
+	}
+	s.caller.transport.close()
+	return s.caller.server.Close()
+}
+
+// callTransport sends each request to the protoxy listening at addr, with the absolute URL that protoxy proxies to.
+// http.Transport can't be used, since it tunnels https requests through a proxy with CONNECT. A connection is reused
+// once the body of its response has been read to the end and closed.
+type callTransport struct {
+	addr string
+
+	mu     sync.Mutex
+	idle   []*callConn
+	closed bool
+}
+
+// callConn is a connection to protoxy, with the reader its responses are read from.
+type callConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (t *callTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	conn, err := t.conn(req.Context())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	if err := req.WriteProxy(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(conn.br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body = &connBody{ReadCloser: resp.Body, conn: conn, transport: t, reusable: !req.Close && !resp.Close}
+	return resp, nil
+}
+
+// conn returns an idle connection, or dials a new one.
+func (t *callTransport) conn(ctx context.Context) (*callConn, error) {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return nil, errServerClosed
+	}
+	if n := len(t.idle); n > 0 {
+		conn := t.idle[n-1]
+		t.idle = t.idle[:n-1]
+		t.mu.Unlock()
+		return conn, nil
+	}
+	t.mu.Unlock()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	return &callConn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// release makes conn available to the next request.
+func (t *callTransport) release(conn *callConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		conn.Close()
+		return
+	}
+	t.idle = append(t.idle, conn)
+}
+
+// close closes the idle connections, and the connections of responses in flight once their bodies are closed.
+func (t *callTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for _, conn := range t.idle {
+		conn.Close()
+	}
+	t.idle = nil
+}
+
+// connBody releases the connection of a response once its body is closed, or closes it if the body wasn't read to
+// the end, since the rest of the body would be read as the next response.
+type connBody struct {
+	io.ReadCloser
+	conn      *callConn
+	transport *callTransport
+	reusable  bool
+	eof       bool
+}
+
+func (b *connBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *connBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.conn == nil {
+		return err
+	}
+	if b.eof && b.reusable && err == nil {
+		b.transport.release(b.conn)
+	} else {
+		b.conn.Close()
+	}
+	b.conn = nil
+	return err
+}
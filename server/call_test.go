@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCall(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(t, err)
+	s := New(Config{FileDescriptors: fds})
+
+	backend := newBackend(t, &testprotos.Req{}, &testprotos.Resp{Text: "called"}, false)
+	defer backend.Close()
+
+	t.Run("converts the request and response", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, backend.URL, strings.NewReader(`{"text":"hi"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", `application/json; reqMsg="testprotos.Req"; respMsg="testprotos.Resp"`)
+
+		resp, err := s.Call(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"text":"called"}`, string(body))
+		assert.Equal(t, "HTTP/1.1", resp.Proto)
+		assert.NotEmpty(t, resp.Header.Get(requestIDHeader))
+	})
+
+	t.Run("https upstream", func(t *testing.T) {
+		tlsBackend := httptest.NewTLSServer(backend.Config.Handler)
+		defer tlsBackend.Close()
+		s := New(Config{FileDescriptors: fds, Transport: TransportConfig{TLSInsecureSkipVerify: true}})
+
+		req, err := http.NewRequest(http.MethodPost, tlsBackend.URL, strings.NewReader(`{"text":"hi"}`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", `application/json; reqMsg="testprotos.Req"; respMsg="testprotos.Resp"`)
+
+		resp, err := s.Call(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"text":"called"}`, string(body))
+	})
+
+	t.Run("conversion errors", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, backend.URL, strings.NewReader(`{"text":`))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", `application/json; reqMsg="testprotos.Req"; respMsg="testprotos.Resp"`)
+
+		resp, err := s.Call(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	})
+
+	t.Run("connections are reused", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		defer s.Close()
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			req, err := http.NewRequest(http.MethodPost, backend.URL, strings.NewReader(`{"text":"hi"}`))
+			require.NoError(t, err)
+			req.Header.Set("Content-Type", `application/json; reqMsg="testprotos.Req"; respMsg="testprotos.Resp"`)
+
+			resp, err := s.Call(req)
+			require.NoError(t, err)
+			conns = append(conns, resp.Body.(*connBody).conn.Conn)
+			_, err = ioutil.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.NoError(t, resp.Body.Close())
+		}
+		assert.Same(t, conns[0], conns[1])
+		assert.Same(t, conns[0], conns[2])
+	})
+
+	t.Run("close", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		req, err := http.NewRequest(http.MethodGet, backend.URL, nil)
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", `application/json; respMsg="testprotos.Resp"`)
+		resp, err := s.Call(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		addr := s.caller.transport.addr
+
+		require.NoError(t, s.Close())
+		_, err = s.Call(req)
+		assert.Error(t, err)
+		_, err = net.Dial("tcp", addr)
+		assert.Error(t, err, "the listener should be closed")
+
+		// A server that was never called can be closed too
+		s = New(Config{FileDescriptors: fds})
+		require.NoError(t, s.Close())
+		_, err = s.Call(req)
+		assert.Equal(t, errServerClosed, err)
+	})
+
+	t.Run("relative URL", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "/hello", nil)
+		require.NoError(t, err)
+		_, err = s.Call(req)
+		assert.Error(t, err)
+	})
+}
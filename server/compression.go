@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content-Encodings that protoxy can decompress responses from and compress requests with.
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+	encodingBrotli  = "br"
+	encodingZstd    = "zstd"
+)
+
+// parseContentEncoding splits a Content-Encoding header into its codings, in the order they were applied.
+// The identity coding is dropped.
+func parseContentEncoding(header string) []string {
+	var codings []string
+	for _, c := range strings.Split(header, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		if c != "" && c != "identity" {
+			codings = append(codings, c)
+		}
+	}
+	return codings
+}
+
+// decompress undoes every coding in the Content-Encoding header, last applied first. It returns errBodyTooLarge if
+// any stage decodes to more than limit bytes. A limit of 0 means no limit.
+func decompress(contentEncoding string, b []byte, limit int64) ([]byte, error) {
+	codings := parseContentEncoding(contentEncoding)
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		src := bytes.NewReader(b)
+		switch codings[i] {
+		case encodingGzip, "x-gzip":
+			r, err = gzip.NewReader(src)
+		case encodingDeflate:
+			r, err = zlib.NewReader(src)
+		case encodingBrotli:
+			r = brotli.NewReader(src)
+		case encodingZstd:
+			var dec *zstd.Decoder
+			dec, err = zstd.NewReader(src)
+			if err == nil {
+				defer dec.Close()
+				r = dec
+			}
+		default:
+			return nil, fmt.Errorf("unsupported Content-Encoding '%v'", codings[i])
+		}
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 {
+			r = io.LimitReader(r, limit+1)
+		}
+		if b, err = ioutil.ReadAll(r); err != nil {
+			return nil, err
+		}
+		if limit > 0 && int64(len(b)) > limit {
+			return nil, errBodyTooLarge
+		}
+	}
+	return b, nil
+}
+
+// compress encodes b with a single Content-Encoding coding.
+func compress(coding string, b []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(nil)
+	var w io.WriteCloser
+	var err error
+	switch strings.ToLower(coding) {
+	case encodingGzip:
+		w = gzip.NewWriter(buf)
+	case encodingDeflate:
+		w = zlib.NewWriter(buf)
+	case encodingBrotli:
+		w = brotli.NewWriter(buf)
+	case encodingZstd:
+		w, err = zstd.NewWriter(buf)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding '%v'", coding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(b); err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressRequestBody compresses the converted request body with coding and sets Content-Encoding to match.
+// Requests without a body are left as they are.
+func compressRequestBody(r *http.Request, coding string) error {
+	if coding == "" || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return fmt.Errorf("Unable to read request body: %v", err)
+	}
+	if len(body) == 0 {
+		r.Body = http.NoBody
+		return nil
+	}
+	b, err := compress(coding, body)
+	if err != nil {
+		return fmt.Errorf("Unable to compress request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	r.Header.Set("Content-Encoding", strings.ToLower(coding))
+	return nil
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// EncodeJSON converts js to the binary encoding of messageType, the same way request bodies are converted. If
+// messageType is empty and RawFallback is set, js is encoded without a schema.
+func (s *Server) EncodeJSON(js []byte, messageType string) ([]byte, error) {
+	if messageType == "" {
+		if !s.RawFallback {
+			return nil, fmt.Errorf("A message type is required unless raw fallback is enabled")
+		}
+		return encodeRawJSON(bytes.NewReader(js))
+	}
+	md := s.findMessage(messageType)
+	if md == nil {
+		return nil, fmt.Errorf("Failed to find message descriptor for '%v'", messageType)
+	}
+	_, b, err := s.jsonToProto(context.Background(), js, md)
+	return b, err
+}
+
+// DecodeProto converts the binary encoding of a message to JSON, the same way response bodies are converted. Each of
+// messageTypes is tried in order. If none are given or none match and RawFallback is set, b is decoded without a
+// schema.
+func (s *Server) DecodeProto(b []byte, messageTypes []string) ([]byte, error) {
+	descs := []*desc.MessageDescriptor{}
+	for _, t := range messageTypes {
+		md := s.findMessage(t)
+		if md == nil {
+			return nil, fmt.Errorf("Failed to find message descriptor for '%v'", t)
+		}
+		descs = append(descs, md)
+	}
+	if len(descs) == 0 {
+		if !s.RawFallback {
+			return nil, fmt.Errorf("A message type is required unless raw fallback is enabled")
+		}
+		return decodeRawJSON(b)
+	}
+
+	msg, err := unmarshalFirst(b, descs)
+	if err != nil {
+		if s.RawFallback {
+			return decodeRawJSON(b)
+		}
+		return nil, err
+	}
+	return s.protoToJSON(msg)
+}
+
+func decodeRawJSON(b []byte) ([]byte, error) {
+	msg, err := decodeRaw(b)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode raw protobuf: %v", err)
+	}
+	return json.Marshal(msg)
+}
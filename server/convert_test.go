@@ -0,0 +1,59 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConvert(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(t, err)
+
+	t.Run("round trip", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		b, err := s.EncodeJSON([]byte(`{"text":"hi","number":3}`), "testprotos.Req")
+		require.NoError(t, err)
+		assert.Equal(t, []byte{0x0a, 0x02, 'h', 'i', 0x10, 0x03}, b)
+
+		js, err := s.DecodeProto(b, []string{"testprotos.Req"})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"text":"hi","number":3,"list":[]}`, string(js))
+	})
+
+	t.Run("multiple types", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		b, err := s.EncodeJSON([]byte(`{"text":"hi"}`), "testprotos.Req")
+		require.NoError(t, err)
+		js, err := s.DecodeProto(b, []string{"testprotos.Resp", "testprotos.Resp2"})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"text":"hi"}`, string(js))
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		_, err := s.EncodeJSON([]byte(`{}`), "testprotos.Missing")
+		assert.Error(t, err)
+		_, err = s.DecodeProto(nil, []string{"testprotos.Missing"})
+		assert.Error(t, err)
+	})
+
+	t.Run("type required without raw fallback", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds})
+		_, err := s.EncodeJSON([]byte(`{}`), "")
+		assert.Error(t, err)
+		_, err = s.DecodeProto(nil, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("raw fallback", func(t *testing.T) {
+		s := New(Config{FileDescriptors: fds, RawFallback: true})
+		b, err := s.EncodeJSON([]byte(`{"1":"hi"}`), "")
+		require.NoError(t, err)
+		js, err := s.DecodeProto(b, nil)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"1":"hi"}`, string(js))
+	})
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/camgraff/protoxy/log"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// headerMessage is a request header whose JSON value is converted to a protobuf message of type messageType.
+type headerMessage struct {
+	name        string
+	messageType string
+}
+
+// parseHeaderParam parses the hdr Content-Type param, a comma-separated list of header names. A name on its own
+// receives the request body message. A name=type pair converts the JSON already sent in that header.
+func parseHeaderParam(param string) (bodyHeader string, headers []headerMessage, err error) {
+	for _, h := range strings.Split(param, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		if i := strings.Index(h, "="); i >= 0 {
+			headers = append(headers, headerMessage{
+				name:        strings.TrimSpace(h[:i]),
+				messageType: strings.TrimSpace(h[i+1:]),
+			})
+			continue
+		}
+		if bodyHeader != "" {
+			return "", nil, fmt.Errorf("the request body can only be sent in one header, got '%v' and '%v'", bodyHeader, h)
+		}
+		bodyHeader = h
+	}
+	return bodyHeader, headers, nil
+}
+
+// encodeHeaderMessages replaces the JSON value of each header in headers with its protobuf encoding, base64'd like
+// gRPC binary metadata.
+func (s *Server) encodeHeaderMessages(r *http.Request, headers []headerMessage) error {
+	for _, h := range headers {
+		md := s.findMessage(h.messageType)
+		if md == nil {
+			return fmt.Errorf("Failed to find message descriptor for '%v' in header %v", h.messageType, h.name)
+		}
+		js := r.Header.Get(h.name)
+		if js == "" {
+			return fmt.Errorf("Header %v is empty", h.name)
+		}
+		_, b, err := s.jsonToProto(r.Context(), []byte(js), md)
+		if err != nil {
+			log.FromContext(r.Context()).WithError(err).WithField("header", h.name).Error("unable to convert header to proto")
+			return err
+		}
+		r.Header.Set(h.name, base64.StdEncoding.EncodeToString(b))
+	}
+	return nil
+}
+
+// findMessage returns the descriptor for the fully-qualified message name, or nil if no loaded file declares it.
+func (s *Server) findMessage(name string) *desc.MessageDescriptor {
+	for _, fd := range s.FileDescriptors {
+		if md := fd.FindMessage(name); md != nil {
+			return md
+		}
+	}
+	return nil
+}
+
+// decodedHeaderPrefix is prepended to the name of a response header to hold its decoded copy.
+const decodedHeaderPrefix = "X-Protoxy-Decoded-"
+
+// decodeResponseHeaders converts the base64 protobuf value of every header configured in s.ResponseHeaders to JSON.
+// Headers are rewritten in place, or copied under decodedHeaderPrefix when s.DecodedHeaderCopies is set.
+// Headers that cannot be decoded are left untouched.
+func (s *Server) decodeResponseHeaders(ctx context.Context, h http.Header) {
+	logger := log.FromContext(ctx)
+	for name, msgType := range s.ResponseHeaders {
+		values := h.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		md := s.findMessage(msgType)
+		if md == nil {
+			logger.WithField("header", name).Warnf("failed to find message descriptor for '%v'", msgType)
+			continue
+		}
+
+		decoded := make([]string, 0, len(values))
+		for _, v := range values {
+			js, err := s.decodeHeaderValue(v, md)
+			if err != nil {
+				logger.WithError(err).WithField("header", name).Warn("unable to decode response header")
+				decoded = nil
+				break
+			}
+			decoded = append(decoded, js)
+		}
+		if decoded == nil {
+			continue
+		}
+
+		target := name
+		if s.DecodedHeaderCopies {
+			target = decodedHeaderPrefix + name
+		}
+		h.Del(target)
+		for _, js := range decoded {
+			h.Add(target, js)
+		}
+	}
+}
+
+func (s *Server) decodeHeaderValue(v string, md *desc.MessageDescriptor) (string, error) {
+	// gRPC senders may or may not pad binary header values
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(v)
+	}
+	if err != nil {
+		return "", err
+	}
+	msg := dynamic.NewMessage(md)
+	if err = msg.Unmarshal(b); err != nil {
+		return "", err
+	}
+	js, err := s.protoToJSON(msg)
+	return string(js), err
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// errBodyTooLarge is returned when a body is larger than the configured limit.
+var errBodyTooLarge = errors.New("body exceeds the size limit")
+
+// readLimited reads all of body if it is at most limit bytes. A limit of 0 means no limit. For larger bodies it
+// returns errBodyTooLarge along with a reader for the whole body, including the bytes already read, so the body can
+// still be streamed elsewhere.
+func readLimited(body io.ReadCloser, contentLength int64, limit int64) ([]byte, io.ReadCloser, error) {
+	if limit <= 0 {
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		return b, nil, err
+	}
+	if contentLength > limit {
+		return nil, body, errBodyTooLarge
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, err
+	}
+	if int64(len(b)) > limit {
+		return nil, &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(b), body), Closer: body}, errBodyTooLarge
+	}
+	return b, nil, body.Close()
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// limitRequestBody buffers the request body if it fits in s.MaxRequestBytes. It returns errBodyTooLarge, with the
+// body left readable, if it does not.
+func (s *Server) limitRequestBody(r *http.Request) error {
+	if s.MaxRequestBytes <= 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	b, overflow, err := readLimited(r.Body, r.ContentLength, s.MaxRequestBytes)
+	if overflow != nil {
+		r.Body = overflow
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read request body: %v", err)
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	return nil
+}
+
+func writeBodyTooLargeResponse(w http.ResponseWriter, status int, body string, limit int64) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "The %v body exceeds the %v byte limit of Protoxy.", body, limit)
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadLimited(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		limit         int64
+		tooLarge      bool
+	}{
+		{name: "no limit", body: "0123456789", contentLength: -1},
+		{name: "at the limit", body: "0123456789", contentLength: -1, limit: 10},
+		{name: "over the limit", body: "0123456789", contentLength: -1, limit: 9, tooLarge: true},
+		{name: "content length over the limit", body: "0123456789", contentLength: 10, limit: 9, tooLarge: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, overflow, err := readLimited(ioutil.NopCloser(strings.NewReader(tc.body)), tc.contentLength, tc.limit)
+			if !tc.tooLarge {
+				require.NoError(t, err)
+				assert.Nil(t, overflow)
+				assert.Equal(t, tc.body, string(b))
+				return
+			}
+			assert.Equal(t, errBodyTooLarge, err)
+			require.NotNil(t, overflow)
+			// The whole body is still available for streaming
+			all, err := ioutil.ReadAll(overflow)
+			require.NoError(t, err)
+			assert.Equal(t, tc.body, string(all))
+		})
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/sirupsen/logrus"
+)
+
+// requestIDHeader correlates the log entries of a request. It is passed upstream and returned to the client.
+const requestIDHeader = "X-Request-ID"
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// dumpPayload logs the JSON of msg at debug level if s.LogPayloads is set. Redacted fields are masked.
+func (s *Server) dumpPayload(logger *logrus.Entry, payload string, msg *dynamic.Message) {
+	if !s.LogPayloads || msg == nil || !logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	js, err := s.protoToJSON(msg)
+	if err == nil {
+		js, err = s.redactor.redactJSON(js, msg)
+	}
+	if err != nil {
+		logger.WithError(err).Warnf("unable to dump %v payload", payload)
+		return
+	}
+	logger.WithFields(logrus.Fields{
+		"message_type": msg.GetMessageDescriptor().GetFullyQualifiedName(),
+		"payload":      string(js),
+	}).Debugf("%v payload", payload)
+}
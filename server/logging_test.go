@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/log"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogging(t *testing.T) {
+	// Capture log entries as JSON
+	buf := bytes.NewBuffer(nil)
+	out, formatter, level := log.Log.Out, log.Log.Formatter, log.Log.Level
+	defer func() {
+		log.Log.Out, log.Log.Formatter, log.Log.Level = out, formatter, level
+	}()
+	log.Log.Out = buf
+	log.Log.Formatter = &logrus.JSONFormatter{}
+	log.Log.Level = logrus.DebugLevel
+	entries := func() []map[string]interface{} {
+		var entries []map[string]interface{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var entry map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(line), &entry))
+			entries = append(entries, entry)
+		}
+		return entries
+	}
+
+	var upstreamRequestID string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRequestID = r.Header.Get("X-Request-ID")
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"sensitive.proto"})
+	require.NoError(t, err)
+	reqBody := `{"username":"ada","password":"hunter2","token":{"value":"abc","expires":"10"},"history":[{"value":"def","expires":"5"}],"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"ghi"}]}`
+
+	t.Run("request ID is propagated", func(t *testing.T) {
+		buf.Reset()
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"username":`))
+		req.Header.Add("Content-Type", "application/json; reqMsg=fixtures.Credentials; respMsg=fixtures.Credentials")
+		req.Header.Set("X-Request-ID", "my-request")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		assert.Equal(t, "my-request", respRecorder.Header().Get("X-Request-ID"))
+		logged := entries()
+		require.NotEmpty(t, logged)
+		for _, entry := range logged {
+			assert.Equal(t, "my-request", entry["request_id"], entry["msg"])
+		}
+	})
+
+	t.Run("request ID is generated", func(t *testing.T) {
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(reqBody))
+		req.Header.Add("Content-Type", "application/json; reqMsg=fixtures.Credentials; respMsg=fixtures.Credentials")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusOK, respRecorder.Code)
+		assert.Len(t, respRecorder.Header().Get("X-Request-ID"), 32)
+		assert.Equal(t, respRecorder.Header().Get("X-Request-ID"), upstreamRequestID)
+	})
+
+	t.Run("payload dumps are redacted", func(t *testing.T) {
+		buf.Reset()
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(reqBody))
+		req.Header.Add("Content-Type", "application/json; reqMsg=fixtures.Credentials; respMsg=fixtures.Credentials")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds, LogPayloads: true, RedactOptions: []string{"fixtures.sensitive"}})
+		srv.proxyRequest(respRecorder, req)
+		require.Equal(t, http.StatusOK, respRecorder.Code)
+
+		payloads := map[string]string{}
+		for _, entry := range entries() {
+			if p, ok := entry["payload"].(string); ok {
+				payloads[entry["msg"].(string)] = p
+				assert.Equal(t, "fixtures.Credentials", entry["message_type"])
+			}
+		}
+		expected := `{"username":"ada","password":"[REDACTED]","token":{"value":"[REDACTED]","expires":"10"},"history":[{"value":"[REDACTED]","expires":"5"}],"apiKey":"[REDACTED]","email":"","sessions":{},"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"0"}]}`
+		assert.JSONEq(t, expected, payloads["request payload"])
+		assert.JSONEq(t, expected, payloads["response payload"])
+		// The payloads themselves are not redacted
+		assert.Contains(t, respRecorder.Body.String(), "hunter2")
+	})
+
+	t.Run("payload dumps are off by default", func(t *testing.T) {
+		buf.Reset()
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(reqBody))
+		req.Header.Add("Content-Type", "application/json; reqMsg=fixtures.Credentials; respMsg=fixtures.Credentials")
+		srv := New(Config{FileDescriptors: fds})
+		srv.proxyRequest(httptest.NewRecorder(), req)
+
+		assert.NotContains(t, buf.String(), "payload")
+	})
+}
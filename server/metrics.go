@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of a proxied request. Failures are labeled with the stage of proxyRequest they happened in.
+const (
+	outcomeOK       = "ok"
+	outcomeParse    = "parse"
+	outcomeLookup   = "lookup"
+	outcomeEncode   = "encode"
+	outcomeUpstream = "upstream"
+	outcomeDecode   = "decode"
+)
+
+var requestLabels = []string{"host", "request_message", "response_message", "outcome"}
+
+// Label values for hosts that aren't configured upstreams, and for message types that weren't found.
+const (
+	otherHostLabel      = "other"
+	unknownMessageLabel = "unknown"
+)
+
+// metrics holds the Prometheus metrics of a Server. Each Server has its own registry.
+type metrics struct {
+	registry    *prometheus.Registry
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	descriptors prometheus.Gauge
+	lastReload  prometheus.Gauge
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "protoxy_requests_total",
+			Help: "Number of proxied requests.",
+		}, requestLabels),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "protoxy_request_duration_seconds",
+			Help:    "Time taken to proxy requests, including conversion.",
+			Buckets: prometheus.DefBuckets,
+		}, requestLabels),
+		descriptors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "protoxy_descriptors_loaded",
+			Help: "Number of proto file descriptors loaded.",
+		}),
+		lastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "protoxy_schema_last_reload_timestamp_seconds",
+			Help: "Unix time the proto schemas were last loaded.",
+		}),
+	}
+	m.registry.MustRegister(
+		m.requests,
+		m.duration,
+		m.descriptors,
+		m.lastReload,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observe records a request that started at start.
+func (m *metrics) observe(state *requestState, start time.Time) {
+	labels := prometheus.Labels{
+		"host":             state.host,
+		"request_message":  state.requestMessage,
+		"response_message": state.responseMessage,
+		"outcome":          state.outcome,
+	}
+	m.requests.With(labels).Inc()
+	m.duration.With(labels).Observe(time.Since(start).Seconds())
+}
+
+// messageLabels returns the request_message and response_message labels for the message types requested in types.
+// They are the names of the descriptors that were found, or unknownMessageLabel if a type was requested but none were
+// found.
+func messageLabels(types protoTypes, reqMsgDesc *desc.MessageDescriptor, respMsgDescs []*desc.MessageDescriptor) (string, string) {
+	var reqLabel, respLabel string
+	if reqMsgDesc != nil {
+		reqLabel = reqMsgDesc.GetFullyQualifiedName()
+	} else if types.requestMessage != "" {
+		reqLabel = unknownMessageLabel
+	}
+	if len(respMsgDescs) > 0 {
+		names := make([]string, len(respMsgDescs))
+		for i, d := range respMsgDescs {
+			names[i] = d.GetFullyQualifiedName()
+		}
+		respLabel = strings.Join(names, ",")
+	} else if len(types.responseMessages) > 0 {
+		respLabel = unknownMessageLabel
+	}
+	return reqLabel, respLabel
+}
+
+// schemaLoaded updates the schema gauges after files have been loaded.
+func (m *metrics) schemaLoaded(files []*desc.FileDescriptor) {
+	m.descriptors.Set(float64(len(files)))
+	m.lastReload.SetToCurrentTime()
+}
+
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMetrics(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/garbage" {
+			w.Write([]byte{0xff, 0xff, 0xff})
+			return
+		}
+		resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+		require.NoError(t, err)
+		w.Write(resp)
+	}))
+	defer backend.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(t, err)
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	srv := New(Config{FileDescriptors: fds, Upstreams: map[string]TransportConfig{backendHost: {}}})
+	handler := srv.Handler()
+	tests := []struct {
+		name        string
+		url         string
+		contentType string
+		body        string
+		labels      prometheus.Labels
+	}{
+		{
+			// Requests with an absolute URL are proxied, even to a /metrics path
+			name:        "ok",
+			url:         backend.URL + "/metrics",
+			contentType: "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp",
+			body:        `{"text":"some text"}`,
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "testprotos.Req", "response_message": "testprotos.Resp", "outcome": "ok"},
+		},
+		{
+			name:        "parse",
+			url:         backend.URL,
+			contentType: "application/json; reqMsg",
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "", "response_message": "", "outcome": "parse"},
+		},
+		{
+			// Requests without respMsg aren't labeled as having unknown response messages
+			name:        "no response message",
+			url:         backend.URL,
+			contentType: "application/json; reqMsg=testprotos.Req",
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "testprotos.Req", "response_message": "", "outcome": "lookup"},
+		},
+		{
+			name:        "lookup",
+			url:         backend.URL,
+			contentType: "application/json; reqMsg=testprotos.Unknown; respMsg=testprotos.Resp",
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "unknown", "response_message": "testprotos.Resp", "outcome": "lookup"},
+		},
+		{
+			// The names of messages that weren't found aren't used as labels
+			name:        "unknown response messages",
+			url:         backend.URL,
+			contentType: "application/json; reqMsg=testprotos.Req; respMsg=\"testprotos.Missing1,testprotos.Missing2\"",
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "testprotos.Req", "response_message": "unknown", "outcome": "lookup"},
+		},
+		{
+			name:        "encode",
+			url:         backend.URL,
+			contentType: "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp",
+			body:        `{"text":`,
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "testprotos.Req", "response_message": "testprotos.Resp", "outcome": "encode"},
+		},
+		{
+			name:        "upstream",
+			url:         closed.URL,
+			contentType: "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp",
+			body:        `{"text":"some text"}`,
+			// Hosts that aren't configured upstreams share a label
+			labels: prometheus.Labels{"host": "other", "request_message": "testprotos.Req", "response_message": "testprotos.Resp", "outcome": "upstream"},
+		},
+		{
+			name:        "decode",
+			url:         backend.URL + "/garbage",
+			contentType: "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp",
+			body:        `{"text":"some text"}`,
+			labels:      prometheus.Labels{"host": backendHost, "request_message": "testprotos.Req", "response_message": "testprotos.Resp", "outcome": "decode"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tc.url, strings.NewReader(tc.body))
+			req.Header.Add("Content-Type", tc.contentType)
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, 1.0, testutil.ToFloat64(srv.metrics.requests.With(tc.labels)))
+		})
+	}
+
+	t.Run("metrics endpoint", func(t *testing.T) {
+		respRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(respRecorder, httptest.NewRequest("GET", "/metrics", nil))
+
+		assert.Equal(t, http.StatusOK, respRecorder.Code)
+		body, err := ioutil.ReadAll(respRecorder.Body)
+		require.NoError(t, err)
+		assert.Contains(t, string(body), `protoxy_requests_total{host="`+backendHost+`",outcome="ok",request_message="testprotos.Req",response_message="testprotos.Resp"} 1`)
+		assert.Contains(t, string(body), `protoxy_request_duration_seconds_count{host="`+backendHost+`",outcome="decode"`)
+		assert.Contains(t, string(body), "protoxy_descriptors_loaded 1")
+		assert.Contains(t, string(body), "protoxy_schema_last_reload_timestamp_seconds")
+	})
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/camgraff/protoxy/log"
+)
+
+// encodeMultipart converts the parts of a multipart request body whose Content-Type has a reqMsg param, such as
+// `application/json; reqMsg=example.Metadata`, to protobuf. All other parts are passed through unchanged.
+func (s *Server) encodeMultipart(r *http.Request, ptypes protoTypes) error {
+	reader := multipart.NewReader(r.Body, ptypes.boundary)
+	buf := bytes.NewBuffer(nil)
+	writer := multipart.NewWriter(buf)
+	if err := writer.SetBoundary(ptypes.boundary); err != nil {
+		return fmt.Errorf("Invalid multipart boundary: %v", err)
+	}
+
+	for {
+		part, err := reader.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to read multipart body: %v", err)
+		}
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			return fmt.Errorf("Unable to read multipart body: %v", err)
+		}
+
+		header := part.Header
+		if _, params, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil && params["reqmsg"] != "" {
+			md := s.findMessage(params["reqmsg"])
+			if md == nil {
+				return fmt.Errorf("Failed to find message descriptor for '%v' in part %v", params["reqmsg"], part.FormName())
+			}
+			if _, content, err = s.jsonToProto(r.Context(), content, md); err != nil {
+				log.FromContext(r.Context()).WithError(err).WithField("part", part.FormName()).Error("unable to convert multipart part to proto")
+				return err
+			}
+			header.Set("Content-Type", "application/x-protobuf")
+		}
+
+		w, err := writer.CreatePart(header)
+		if err != nil {
+			return fmt.Errorf("Unable to write multipart body: %v", err)
+		}
+		if _, err = w.Write(content); err != nil {
+			return fmt.Errorf("Unable to write multipart body: %v", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("Unable to write multipart body: %v", err)
+	}
+
+	r.Body = ioutil.NopCloser(buf)
+	r.ContentLength = int64(buf.Len())
+	return nil
+}
+
+func isMultipart(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "multipart/")
+}
@@ -0,0 +1,488 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/camgraff/protoxy/log"
+
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+)
+
+// openAPIVersion is the version of the OpenAPI specification that generated documents follow.
+const openAPIVersion = "3.0.3"
+
+// validationErrorSchema is the name of the schema for the 400 responses Protoxy sends for invalid requests.
+const validationErrorSchema = "protoxy.ValidationError"
+
+// OpenAPIOptions configures a generated OpenAPI document.
+type OpenAPIOptions struct {
+	Title   string
+	Version string
+	// Servers are the base URLs of the upstream API.
+	Servers []string
+	// Routes document endpoints in addition to those bound with google.api.http options.
+	Routes []Route
+}
+
+// Route documents an endpoint that has no google.api.http option. Target is either a fully-qualified method, such as
+// example.Library.GetBook, or a request and response message separated by a colon, such as
+// example.GetBookRequest:example.Book. GET, HEAD and DELETE routes send the request in the query string with the flat
+// encoding, other routes send it as the body.
+type Route struct {
+	Method string
+	Path   string
+	Target string
+}
+
+// ParseRoute parses a route written as METHOD PATH=TARGET, such as "GET /v1/books/{name}=example.Library.GetBook".
+func ParseRoute(s string) (Route, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return Route{}, fmt.Errorf("Route '%v' must be written as METHOD PATH=TARGET", s)
+	}
+	fields := strings.Fields(s[:i])
+	target := strings.TrimSpace(s[i+1:])
+	if len(fields) != 2 || target == "" {
+		return Route{}, fmt.Errorf("Route '%v' must be written as METHOD PATH=TARGET", s)
+	}
+	return Route{Method: strings.ToUpper(fields[0]), Path: fields[1], Target: target}, nil
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Servers    []openAPIServer                         `json:"servers,omitempty"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openAPIServer struct {
+	URL string `json:"url"`
+}
+
+type openAPIComponents struct {
+	Schemas map[string]*openAPISchema `json:"schemas"`
+}
+
+type openAPIOperation struct {
+	OperationID string                     `json:"operationId"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Description string                     `json:"description,omitempty"`
+	Parameters  []openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+	// ContentType is the Content-Type to send the request through Protoxy with.
+	ContentType string `json:"x-protoxy-content-type"`
+}
+
+type openAPIParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Required    bool           `json:"required,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Style       string         `json:"style,omitempty"`
+	Schema      *openAPISchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                        `json:"required"`
+	Content  map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                      `json:"description"`
+	Content     map[string]openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Description          string                    `json:"description,omitempty"`
+	Enum                 []string                  `json:"enum,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	AdditionalProperties *openAPISchema            `json:"additionalProperties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+}
+
+// openAPIMethods are the HTTP methods that OpenAPI can describe.
+var openAPIMethods = map[string]bool{"GET": true, "PUT": true, "POST": true, "DELETE": true, "OPTIONS": true, "HEAD": true, "PATCH": true, "TRACE": true}
+
+// nonIdentifier matches the characters that are replaced to turn a route into an operation ID.
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9]+`)
+
+// OpenAPI returns an OpenAPI 3 document of the JSON that clients send to and receive from Protoxy. Every HTTP binding
+// of a service method is documented, along with opts.Routes. Schemas follow the JSON mapping the proxy uses, so
+// fields are named by their JSON names, 64-bit integers are strings and enums are value names.
+func (s *Server) OpenAPI(opts OpenAPIOptions) ([]byte, error) {
+	g := &openAPIGenerator{
+		doc: openAPIDocument{
+			OpenAPI:    openAPIVersion,
+			Info:       openAPIInfo{Title: opts.Title, Version: opts.Version},
+			Paths:      map[string]map[string]*openAPIOperation{},
+			Components: openAPIComponents{Schemas: map[string]*openAPISchema{validationErrorSchema: validationErrorOpenAPISchema()}},
+		},
+	}
+	for _, u := range opts.Servers {
+		g.doc.Servers = append(g.doc.Servers, openAPIServer{URL: u})
+	}
+
+	routed := map[*desc.MethodDescriptor]bool{}
+	for _, r := range opts.Routes {
+		b := HTTPBinding{Method: r.Method, Path: r.Path, Body: "*"}
+		switch r.Method {
+		case "GET", "HEAD", "DELETE":
+			b.Body = ""
+		}
+		// Name the operation after the route, without the patterns of its path params
+		path := pathParam.ReplaceAllString(r.Path, "{$1}")
+		operationID := strings.Trim(nonIdentifier.ReplaceAllString(strings.ToLower(r.Method)+"_"+path, "_"), "_")
+
+		if md, ok := s.findSymbol(r.Target).(*desc.MethodDescriptor); ok {
+			if len(s.httpBindings(md)) == 0 {
+				// The method isn't documented under its own name elsewhere
+				routed[md] = true
+				operationID = fmt.Sprintf("%v_%v", md.GetService().GetName(), md.GetName())
+			}
+			reqMsg, respMsg := bindingMessages(md, b)
+			err := g.addOperation(b, reqMsg, respMsg, &openAPIOperation{
+				OperationID: operationID,
+				Tags:        []string{md.GetService().GetFullyQualifiedName()},
+				Description: comment(md),
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		types := strings.SplitN(r.Target, ":", 2)
+		if len(types) != 2 {
+			return nil, fmt.Errorf("Route target '%v' is not a method or a REQUEST:RESPONSE pair of messages", r.Target)
+		}
+		reqMsg, respMsg := s.findMessage(types[0]), s.findMessage(types[1])
+		if reqMsg == nil || respMsg == nil {
+			return nil, fmt.Errorf("Failed to find message descriptors for route target '%v'", r.Target)
+		}
+		if err := g.addOperation(b, reqMsg, respMsg, &openAPIOperation{OperationID: operationID}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, svc := range s.Schema().Services {
+		sd := s.findSymbol(svc.Name).(*desc.ServiceDescriptor)
+		for _, m := range svc.Methods {
+			md := sd.FindMethodByName(m.Name)
+			if m.ClientStreaming || m.ServerStreaming || routed[md] {
+				continue
+			}
+			for i, b := range m.bindings(svc.Name) {
+				operationID := fmt.Sprintf("%v_%v", sd.GetName(), m.Name)
+				if i > 0 {
+					operationID = fmt.Sprintf("%v_%v", operationID, i+1)
+				}
+				reqMsg, respMsg := bindingMessages(md, b)
+				err := g.addOperation(b, reqMsg, respMsg, &openAPIOperation{
+					OperationID: operationID,
+					Tags:        []string{svc.Name},
+					Description: comment(md),
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(g.doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openAPIGenerator builds an OpenAPI document, adding a component schema for every message that is referenced.
+type openAPIGenerator struct {
+	doc openAPIDocument
+}
+
+// addOperation documents op as the operation for b, which converts reqMsg and respMsg. Without a body, the fields of
+// reqMsg that aren't bound to the path are documented as query params, following the flat query string encoding. It
+// fails if another operation was already added for the same method and path.
+func (g *openAPIGenerator) addOperation(b HTTPBinding, reqMsg *desc.MessageDescriptor, respMsg *desc.MessageDescriptor, op *openAPIOperation) error {
+	if !openAPIMethods[b.Method] {
+		log.Log.WithField("method", b.Method).WithField("path", b.Path).Warn("skipping endpoint with a custom HTTP method that OpenAPI can't describe")
+		return nil
+	}
+
+	op.ContentType = fmt.Sprintf(`application/x-protobuf; reqMsg="%v"; respMsg="%v";`, reqMsg.GetFullyQualifiedName(), respMsg.GetFullyQualifiedName())
+	pathFields := map[string]bool{}
+	path := pathParam.ReplaceAllStringFunc(b.Path, func(param string) string {
+		m := pathParam.FindStringSubmatch(param)
+		pathFields[m[1]] = true
+		schema := &openAPISchema{Type: "string"}
+		if fd := findFieldPath(reqMsg, m[1]); fd != nil && fd.GetMessageType() == nil && !fd.IsRepeated() {
+			schema = g.valueSchema(fd)
+		}
+		description := ""
+		if m[2] != "" {
+			description = fmt.Sprintf("Matches the pattern %v.", m[2])
+		}
+		op.Parameters = append(op.Parameters, openAPIParameter{Name: m[1], In: "path", Required: true, Description: description, Schema: schema})
+		return "{" + m[1] + "}"
+	})
+
+	if b.Body == "" {
+		op.ContentType += " qsEncoding=flat;"
+		g.addQueryParams(op, reqMsg, "", pathFields, map[string]bool{})
+	} else {
+		op.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content:  map[string]openAPIMediaType{"application/json": {Schema: g.messageSchemaRef(reqMsg)}},
+		}
+	}
+	op.Responses = map[string]openAPIResponse{
+		"200": {
+			Description: "The upstream response, converted to JSON.",
+			Content:     map[string]openAPIMediaType{"application/json": {Schema: g.messageSchemaRef(respMsg)}},
+		},
+		"400": {
+			Description: "The request could not be converted to protobuf. Requests with missing required fields or validation errors get a JSON list of the violations.",
+			Content:     map[string]openAPIMediaType{"application/json": {Schema: &openAPISchema{Ref: "#/components/schemas/" + validationErrorSchema}}},
+		},
+	}
+
+	method := strings.ToLower(b.Method)
+	if existing := g.doc.Paths[path][method]; existing != nil {
+		return fmt.Errorf("Endpoint %v %v is documented by both %v and %v", b.Method, path, existing.OperationID, op.OperationID)
+	}
+	if g.doc.Paths[path] == nil {
+		g.doc.Paths[path] = map[string]*openAPIOperation{}
+	}
+	g.doc.Paths[path][method] = op
+	return nil
+}
+
+// addQueryParams adds a query param for each field of md, named by its dotted path like the flat encoding. Nested
+// messages are flattened unless they are already being flattened on the way down. Repeated messages are left out,
+// since their elements can't be told apart in a flat query string.
+func (g *openAPIGenerator) addQueryParams(op *openAPIOperation, md *desc.MessageDescriptor, prefix string, pathFields map[string]bool, seen map[string]bool) {
+	seen[md.GetFullyQualifiedName()] = true
+	defer delete(seen, md.GetFullyQualifiedName())
+
+	for _, fd := range md.GetFields() {
+		name := prefix + fd.GetName()
+		if pathFields[name] {
+			continue
+		}
+		param := openAPIParameter{Name: name, In: "query", Description: comment(fd), Schema: g.queryParamSchema(fd)}
+		mt := fd.GetMessageType()
+		switch {
+		case fd.IsMap():
+			param.Style = "deepObject"
+		case mt != nil && wellKnownOpenAPISchema(mt) == nil:
+			if !fd.IsRepeated() && !seen[mt.GetFullyQualifiedName()] {
+				g.addQueryParams(op, mt, name+".", pathFields, seen)
+			}
+			continue
+		}
+		op.Parameters = append(op.Parameters, param)
+	}
+}
+
+// findFieldPath returns the field of md at a dotted path such as book.name, or nil if there is none.
+func findFieldPath(md *desc.MessageDescriptor, path string) *desc.FieldDescriptor {
+	var fd *desc.FieldDescriptor
+	for _, name := range strings.Split(path, ".") {
+		if md == nil {
+			return nil
+		}
+		if fd = md.FindFieldByName(name); fd == nil {
+			return nil
+		}
+		md = fd.GetMessageType()
+	}
+	return fd
+}
+
+// messageSchemaRef returns a reference to the component schema for md, adding it and the schemas of its fields to
+// the document if needed. Well-known types are described inline.
+func (g *openAPIGenerator) messageSchemaRef(md *desc.MessageDescriptor) *openAPISchema {
+	if schema := wellKnownOpenAPISchema(md); schema != nil {
+		return schema
+	}
+	name := md.GetFullyQualifiedName()
+	if _, ok := g.doc.Components.Schemas[name]; !ok {
+		// Add the schema before its fields, so that recursive messages refer back to it
+		schema := &openAPISchema{Type: "object", Description: comment(md), Properties: map[string]*openAPISchema{}}
+		g.doc.Components.Schemas[name] = schema
+		for _, fd := range md.GetFields() {
+			schema.Properties[fd.GetJSONName()] = g.fieldSchema(fd)
+			if fd.IsRequired() {
+				schema.Required = append(schema.Required, fd.GetJSONName())
+			}
+		}
+	}
+	return &openAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func (g *openAPIGenerator) fieldSchema(fd *desc.FieldDescriptor) *openAPISchema {
+	var schema *openAPISchema
+	switch {
+	case fd.IsMap():
+		schema = &openAPISchema{Type: "object", AdditionalProperties: g.valueSchema(fd.GetMapValueType())}
+	case fd.IsRepeated():
+		schema = &openAPISchema{Type: "array", Items: g.valueSchema(fd)}
+	case fd.GetMessageType() != nil:
+		// Unset message fields are rendered as null
+		schema = nullableSchema(g.valueSchema(fd))
+	default:
+		schema = g.valueSchema(fd)
+	}
+	return describeField(fd, schema)
+}
+
+// queryParamSchema returns the schema of fd as a query param. Unlike in JSON, a param can't be null.
+func (g *openAPIGenerator) queryParamSchema(fd *desc.FieldDescriptor) *openAPISchema {
+	if fd.IsMap() || fd.IsRepeated() {
+		return g.fieldSchema(fd)
+	}
+	return describeField(fd, g.valueSchema(fd))
+}
+
+// describeField returns schema with the description of fd.
+func describeField(fd *desc.FieldDescriptor, schema *openAPISchema) *openAPISchema {
+	description := comment(fd)
+	if oneof := fd.GetOneOf(); oneof != nil && !oneof.IsSynthetic() {
+		description = strings.TrimSpace(fmt.Sprintf("%v\n\nOnly one field of %v can be set.", description, oneof.GetName()))
+	}
+	if description != "" {
+		// Copy shared schemas, such as those of well-known types, before changing them
+		copied := *schema
+		copied.Description = description
+		schema = &copied
+	}
+	return schema
+}
+
+// nullableSchema returns schema with null allowed. Siblings of $ref are ignored, so references are wrapped in allOf.
+func nullableSchema(schema *openAPISchema) *openAPISchema {
+	if schema.Ref != "" {
+		return &openAPISchema{AllOf: []*openAPISchema{schema}, Nullable: true}
+	}
+	if schema.Type == "" || schema.Nullable {
+		// Schemas without a type, such as that of google.protobuf.Value, already allow null
+		return schema
+	}
+	copied := *schema
+	copied.Nullable = true
+	return &copied
+}
+
+// valueSchema returns the schema of a single value of fd.
+func (g *openAPIGenerator) valueSchema(fd *desc.FieldDescriptor) *openAPISchema {
+	if mt := fd.GetMessageType(); mt != nil {
+		return g.messageSchemaRef(mt)
+	}
+	if et := fd.GetEnumType(); et != nil {
+		schema := &openAPISchema{Type: "string"}
+		for _, v := range et.GetValues() {
+			schema.Enum = append(schema.Enum, v.GetName())
+		}
+		return schema
+	}
+	return scalarOpenAPISchema(fd.GetType())
+}
+
+// scalarOpenAPISchema returns the schema of a scalar type in the JSON mapping. 64-bit integers are rendered as strings.
+func scalarOpenAPISchema(t descriptor.FieldDescriptorProto_Type) *openAPISchema {
+	switch t {
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return &openAPISchema{Type: "integer", Format: "int32"}
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return &openAPISchema{Type: "integer", Format: "int64"}
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return &openAPISchema{Type: "string", Format: "int64"}
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return &openAPISchema{Type: "string", Format: "uint64"}
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return &openAPISchema{Type: "number", Format: "float"}
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return &openAPISchema{Type: "number", Format: "double"}
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return &openAPISchema{Type: "boolean"}
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return &openAPISchema{Type: "string", Format: "byte"}
+	default:
+		return &openAPISchema{Type: "string"}
+	}
+}
+
+// wellKnownOpenAPISchema returns the schema of a well-known type with its own JSON representation, or nil if md is
+// not one.
+func wellKnownOpenAPISchema(md *desc.MessageDescriptor) *openAPISchema {
+	switch md.GetFullyQualifiedName() {
+	case "google.protobuf.Any":
+		return &openAPISchema{
+			Type:                 "object",
+			Properties:           map[string]*openAPISchema{"@type": {Type: "string"}},
+			AdditionalProperties: &openAPISchema{},
+		}
+	case "google.protobuf.Struct":
+		return &openAPISchema{Type: "object", AdditionalProperties: &openAPISchema{}}
+	case "google.protobuf.Value":
+		return &openAPISchema{}
+	case "google.protobuf.ListValue":
+		return &openAPISchema{Type: "array", Items: &openAPISchema{}}
+	case "google.protobuf.Empty":
+		return &openAPISchema{Type: "object"}
+	case "google.protobuf.Timestamp":
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	case "google.protobuf.Duration", "google.protobuf.FieldMask":
+		return &openAPISchema{Type: "string"}
+	case "google.protobuf.DoubleValue", "google.protobuf.FloatValue", "google.protobuf.Int64Value",
+		"google.protobuf.UInt64Value", "google.protobuf.Int32Value", "google.protobuf.UInt32Value",
+		"google.protobuf.BoolValue", "google.protobuf.StringValue", "google.protobuf.BytesValue":
+		schema := scalarOpenAPISchema(md.FindFieldByName("value").GetType())
+		schema.Nullable = true
+		return schema
+	}
+	return nil
+}
+
+func validationErrorOpenAPISchema() *openAPISchema {
+	str := &openAPISchema{Type: "string"}
+	return &openAPISchema{
+		Type: "object",
+		Properties: map[string]*openAPISchema{
+			"violations": {
+				Type: "array",
+				Items: &openAPISchema{
+					Type:       "object",
+					Properties: map[string]*openAPISchema{"field": str, "rule": str, "message": str},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoute(t *testing.T) {
+	r, err := ParseRoute("get /v1/{name=shelves/*}=fixtures.Library.GetBook")
+	require.NoError(t, err)
+	assert.Equal(t, Route{Method: "GET", Path: "/v1/{name=shelves/*}", Target: "fixtures.Library.GetBook"}, r)
+
+	for _, s := range []string{"/v1/books", "GET /v1/books", "GET /v1/books=", "/v1/books=fixtures.Book:fixtures.Book"} {
+		_, err := ParseRoute(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"library.proto", "schema.proto"})
+	require.NoError(t, err)
+	s := New(Config{FileDescriptors: fds})
+
+	b, err := s.OpenAPI(OpenAPIOptions{
+		Title:   "Library",
+		Version: "1.0.0",
+		Servers: []string{"https://api.example.com"},
+		Routes: []Route{
+			{Method: "GET", Path: "/v2/items/{name}", Target: "fixtures.Item:fixtures.Item"},
+			{Method: "DELETE", Path: "/v1/{name=shelves/*/books/*}", Target: "fixtures.Library.DeleteBook"},
+		},
+	})
+	require.NoError(t, err)
+	var doc openAPIDocument
+	require.NoError(t, json.Unmarshal(b, &doc))
+
+	assert.Equal(t, "3.0.3", doc.OpenAPI)
+	assert.Equal(t, openAPIInfo{Title: "Library", Version: "1.0.0"}, doc.Info)
+	assert.Equal(t, []openAPIServer{{URL: "https://api.example.com"}}, doc.Servers)
+
+	operationIDs := map[string]string{}
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			operationIDs[method+" "+path] = op.OperationID
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"get /v1/{name}":                 "Library_GetBook",
+		"post /v1/{parent}/books":        "Library_CreateBook",
+		"put /v1/{parent}/books":         "Library_CreateBook_2",
+		"delete /v1/{name}":              "Library_DeleteBook",
+		"get /v2/items/{name}":           "get_v2_items_name",
+		"post /fixtures.Catalog/GetItem": "Catalog_GetItem",
+	}, operationIDs, "custom methods, streaming methods and the default path of routed methods are left out")
+
+	t.Run("body", func(t *testing.T) {
+		op := doc.Paths["/v1/{parent}/books"]["post"]
+		assert.Equal(t, `application/x-protobuf; reqMsg="fixtures.Book"; respMsg="fixtures.Book";`, op.ContentType)
+		assert.Equal(t, []openAPIParameter{
+			{Name: "parent", In: "path", Required: true, Description: "Matches the pattern shelves/*.", Schema: &openAPISchema{Type: "string"}},
+		}, op.Parameters)
+		require.NotNil(t, op.RequestBody)
+		assert.Equal(t, "#/components/schemas/fixtures.Book", op.RequestBody.Content["application/json"].Schema.Ref)
+		assert.Equal(t, "#/components/schemas/fixtures.Book", op.Responses["200"].Content["application/json"].Schema.Ref)
+		assert.Equal(t, "#/components/schemas/protoxy.ValidationError", op.Responses["400"].Content["application/json"].Schema.Ref)
+	})
+
+	t.Run("query params", func(t *testing.T) {
+		op := doc.Paths["/v2/items/{name}"]["get"]
+		assert.Equal(t, `application/x-protobuf; reqMsg="fixtures.Item"; respMsg="fixtures.Item"; qsEncoding=flat;`, op.ContentType)
+		assert.Nil(t, op.RequestBody)
+		params := map[string]openAPIParameter{}
+		for _, p := range op.Parameters {
+			params[p.Name] = p
+		}
+		assert.Equal(t, "path", params["name"].In)
+		assert.Equal(t, &openAPISchema{Type: "string", Format: "int64", Description: "In cents."}, params["price"].Schema)
+		assert.Equal(t, "deepObject", params["stock"].Style)
+		assert.Equal(t, &openAPISchema{Type: "number", Format: "double"}, params["dimensions.width"].Schema)
+		assert.Equal(t, &openAPISchema{Type: "string", Format: "date-time"}, params["created"].Schema)
+		assert.NotContains(t, params, "dimensions")
+		assert.NotContains(t, params, "related", "repeated messages can't be flattened")
+	})
+
+	t.Run("schemas use the JSON mapping", func(t *testing.T) {
+		item := doc.Components.Schemas["fixtures.Item"]
+		require.NotNil(t, item)
+		assert.Equal(t, "Item is something for sale.", item.Description)
+		assert.Equal(t, &openAPISchema{Type: "string", Enum: []string{"UNKNOWN", "GOOD", "SERVICE"}}, item.Properties["kind"])
+		assert.Equal(t, &openAPISchema{Type: "object", AdditionalProperties: &openAPISchema{Type: "integer", Format: "int32"}}, item.Properties["stock"])
+		assert.Equal(t, &openAPISchema{Type: "array", Items: &openAPISchema{Ref: "#/components/schemas/fixtures.Item"}}, item.Properties["related"])
+		assert.Equal(t, "Only one field of owner can be set.", item.Properties["user"].Description)
+		assert.Equal(t, &openAPISchema{AllOf: []*openAPISchema{{Ref: "#/components/schemas/fixtures.Dimensions"}}, Nullable: true}, item.Properties["dimensions"], "unset message fields are null")
+		assert.Contains(t, doc.Components.Schemas, "fixtures.Dimensions")
+
+		// Property names match the JSON the proxy renders
+		js, err := s.skeleton(fds[1].FindMessage("fixtures.Item"))
+		require.NoError(t, err)
+		var rendered map[string]interface{}
+		require.NoError(t, json.Unmarshal(js, &rendered))
+		for name := range rendered {
+			assert.Contains(t, item.Properties, name)
+		}
+		assert.Contains(t, doc.Components.Schemas["fixtures.CreateBookRequest"].Properties, "requestId")
+	})
+
+	t.Run("proxied responses match the schema", func(t *testing.T) {
+		// Only some fields are set, so that unset messages are rendered as null
+		item := dynamic.NewMessage(fds[1].FindMessage("fixtures.Item"))
+		item.SetFieldByName("name", "widget")
+		part := dynamic.NewMessage(fds[1].FindMessage("fixtures.Item"))
+		part.SetFieldByName("name", "part")
+		item.AddRepeatedFieldByName("related", part)
+		resp, err := item.Marshal()
+		require.NoError(t, err)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(resp)
+		}))
+		defer backend.Close()
+
+		op := doc.Paths["/fixtures.Catalog/GetItem"]["post"]
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", op.ContentType)
+		respRecorder := httptest.NewRecorder()
+		s.proxyRequest(respRecorder, req)
+		require.Equal(t, http.StatusOK, respRecorder.Code)
+
+		var rendered interface{}
+		require.NoError(t, json.Unmarshal(respRecorder.Body.Bytes(), &rendered))
+		assert.Contains(t, rendered, "dimensions")
+		assert.Empty(t, validateOpenAPISchema(&doc, op.Responses["200"].Content["application/json"].Schema, rendered, "$"))
+	})
+
+	t.Run("unknown route target", func(t *testing.T) {
+		_, err := s.OpenAPI(OpenAPIOptions{Routes: []Route{{Method: "GET", Path: "/", Target: "fixtures.Missing"}}})
+		assert.Error(t, err)
+		_, err = s.OpenAPI(OpenAPIOptions{Routes: []Route{{Method: "GET", Path: "/", Target: "fixtures.Missing:fixtures.Item"}}})
+		assert.Error(t, err)
+	})
+
+	t.Run("duplicate endpoints", func(t *testing.T) {
+		_, err := s.OpenAPI(OpenAPIOptions{Routes: []Route{
+			{Method: "GET", Path: "/v2/items", Target: "fixtures.Item:fixtures.Item"},
+			{Method: "GET", Path: "/v2/items", Target: "fixtures.Dimensions:fixtures.Dimensions"},
+		}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "GET /v2/items")
+
+		// A route for an endpoint that is already annotated
+		_, err = s.OpenAPI(OpenAPIOptions{Routes: []Route{{Method: "GET", Path: "/v1/{name=shelves/*/books/*}", Target: "fixtures.Item:fixtures.Item"}}})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "GET /v1/{name}")
+	})
+}
+
+// validateOpenAPISchema returns a message for each part of v, a decoded JSON value at path, that doesn't match schema.
+// It checks the subset of OpenAPI that generated documents use.
+func validateOpenAPISchema(doc *openAPIDocument, schema *openAPISchema, v interface{}, path string) []string {
+	if schema.Ref != "" {
+		return validateOpenAPISchema(doc, doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], v, path)
+	}
+	if v == nil {
+		if schema.Nullable || (schema.Type == "" && len(schema.AllOf) == 0) {
+			return nil
+		}
+		return []string{path + ": null isn't allowed"}
+	}
+
+	var errs []string
+	for _, s := range schema.AllOf {
+		errs = append(errs, validateOpenAPISchema(doc, s, v, path)...)
+	}
+	wrongType := func(got string) []string {
+		return append(errs, fmt.Sprintf("%v: expected %v, got %v", path, schema.Type, got))
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if schema.Type != "" && schema.Type != "object" {
+			return wrongType("an object")
+		}
+		for k, e := range v {
+			prop := schema.Properties[k]
+			if prop == nil {
+				prop = schema.AdditionalProperties
+			}
+			if prop == nil {
+				if schema.Type == "object" {
+					errs = append(errs, fmt.Sprintf("%v: undocumented property %v", path, k))
+				}
+				continue
+			}
+			errs = append(errs, validateOpenAPISchema(doc, prop, e, path+"."+k)...)
+		}
+		for _, k := range schema.Required {
+			if _, ok := v[k]; !ok {
+				errs = append(errs, fmt.Sprintf("%v: missing required property %v", path, k))
+			}
+		}
+	case []interface{}:
+		if schema.Type != "" && schema.Type != "array" {
+			return wrongType("an array")
+		}
+		for i, e := range v {
+			if schema.Items != nil {
+				errs = append(errs, validateOpenAPISchema(doc, schema.Items, e, fmt.Sprintf("%v[%v]", path, i))...)
+			}
+		}
+	case string:
+		if schema.Type != "" && schema.Type != "string" {
+			return wrongType("a string")
+		}
+		if len(schema.Enum) > 0 && !containsString(schema.Enum, v) {
+			errs = append(errs, fmt.Sprintf("%v: %q isn't one of %v", path, v, schema.Enum))
+		}
+	case float64:
+		if schema.Type != "" && schema.Type != "number" && (schema.Type != "integer" || v != float64(int64(v))) {
+			return wrongType(fmt.Sprint(v))
+		}
+	case bool:
+		if schema.Type != "" && schema.Type != "boolean" {
+			return wrongType("a boolean")
+		}
+	}
+	return errs
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
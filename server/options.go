@@ -0,0 +1,74 @@
+package server
+
+import (
+	"reflect"
+
+	"github.com/camgraff/protoxy/log"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// optionsParser reads custom options, which are extensions of an options message such as
+// google.protobuf.FieldOptions declared in the loaded files.
+type optionsParser struct {
+	extensions  []*desc.FieldDescriptor
+	optionsDesc *desc.MessageDescriptor
+	factory     *dynamic.MessageFactory
+}
+
+// newOptionsParser finds the extensions of the options message optionsType that are named in names in files and their
+// dependencies.
+func newOptionsParser(files []*desc.FileDescriptor, optionsType string, names map[string]bool) (*optionsParser, error) {
+	optionsDesc, err := desc.LoadMessageDescriptor(optionsType)
+	if err != nil {
+		return nil, err
+	}
+	p := &optionsParser{optionsDesc: optionsDesc}
+	registry := dynamic.NewExtensionRegistryWithDefaults()
+	seen := map[*desc.FileDescriptor]bool{}
+	var visit func(fd *desc.FileDescriptor)
+	visit = func(fd *desc.FileDescriptor) {
+		if seen[fd] {
+			return
+		}
+		seen[fd] = true
+		for _, ext := range fd.GetExtensions() {
+			if names[ext.GetFullyQualifiedName()] && ext.GetOwner().GetFullyQualifiedName() == optionsDesc.GetFullyQualifiedName() {
+				p.extensions = append(p.extensions, ext)
+				if err := registry.AddExtension(ext); err != nil {
+					log.Log.WithError(err).WithField("option", ext.GetFullyQualifiedName()).Warn("unable to register custom option")
+				}
+			}
+		}
+		for _, dep := range fd.GetDependencies() {
+			visit(dep)
+		}
+	}
+	for _, fd := range files {
+		visit(fd)
+	}
+	p.factory = dynamic.NewMessageFactoryWithExtensionRegistry(registry)
+	return p, nil
+}
+
+// parse returns the options of d with the custom options set, or nil if d has no options or no custom options
+// were found.
+func (p *optionsParser) parse(d desc.Descriptor) (*dynamic.Message, error) {
+	opts := d.GetOptions()
+	if len(p.extensions) == 0 || opts == nil || reflect.ValueOf(opts).IsNil() {
+		return nil, nil
+	}
+	// Options for extensions that aren't compiled into protoxy are kept as unknown fields, so re-parse them
+	// with the extensions found in the loaded files.
+	b, err := proto.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	dm := p.factory.NewDynamicMessage(p.optionsDesc)
+	if err = dm.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return dm, nil
+}
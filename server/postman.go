@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// postmanSchema is the JSON schema of Postman's v2.1 collection format.
+const postmanSchema = "https://schema.getpostman.com/json/collection/v2.1.0/collection.json"
+
+// PostmanOptions configures a generated Postman collection.
+type PostmanOptions struct {
+	// Name is the name of the collection.
+	Name string
+	// BaseURL is the default value of the collection's baseUrl variable, which every request URL starts with.
+	BaseURL string
+	// ProxyHost and ProxyPort are where Protoxy is listening. Every request is sent through this proxy.
+	ProxyHost string
+	ProxyPort uint16
+}
+
+type postmanCollection struct {
+	Info     postmanInfo       `json:"info"`
+	Item     []postmanItem     `json:"item"`
+	Variable []postmanVariable `json:"variable"`
+}
+
+type postmanInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Schema      string `json:"schema"`
+}
+
+// postmanItem is a folder of items, or a single request.
+type postmanItem struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Item        []postmanItem   `json:"item,omitempty"`
+	Request     *postmanRequest `json:"request,omitempty"`
+}
+
+type postmanRequest struct {
+	Method      string            `json:"method"`
+	Header      []postmanVariable `json:"header"`
+	Body        *postmanBody      `json:"body,omitempty"`
+	URL         postmanURL        `json:"url"`
+	Description string            `json:"description,omitempty"`
+	Proxy       postmanProxy      `json:"proxy"`
+}
+
+type postmanBody struct {
+	Mode    string          `json:"mode"`
+	Raw     string          `json:"raw"`
+	Options json.RawMessage `json:"options"`
+}
+
+type postmanURL struct {
+	Raw      string            `json:"raw"`
+	Host     []string          `json:"host"`
+	Path     []string          `json:"path"`
+	Variable []postmanVariable `json:"variable,omitempty"`
+}
+
+// postmanVariable is a key and value, used for collection variables, path variables and headers.
+type postmanVariable struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+}
+
+type postmanProxy struct {
+	Match string `json:"match"`
+	Host  string `json:"host"`
+	Port  uint16 `json:"port"`
+}
+
+// PostmanCollection returns a Postman v2.1 collection with a folder for each service and a request for each HTTP
+// binding of its methods. Requests are sent through Protoxy with the Content-Type params for the method's messages
+// and a sample JSON body. Streaming methods are left out, since they can't be proxied.
+func (s *Server) PostmanCollection(opts PostmanOptions) ([]byte, error) {
+	collection := postmanCollection{
+		Info: postmanInfo{
+			Name:        opts.Name,
+			Description: "Generated by Protoxy.",
+			Schema:      postmanSchema,
+		},
+		Item:     []postmanItem{},
+		Variable: []postmanVariable{{Key: "baseUrl", Value: opts.BaseURL}},
+	}
+
+	for _, svc := range s.Schema().Services {
+		sd := s.findSymbol(svc.Name).(*desc.ServiceDescriptor)
+		folder := postmanItem{Name: svc.Name, Description: comment(sd), Item: []postmanItem{}}
+		for _, m := range svc.Methods {
+			if m.ClientStreaming || m.ServerStreaming {
+				continue
+			}
+			md := sd.FindMethodByName(m.Name)
+			for i, b := range m.bindings(svc.Name) {
+				req, err := s.postmanRequest(md, b, opts)
+				if err != nil {
+					return nil, err
+				}
+				name := m.Name
+				if i > 0 {
+					name = fmt.Sprintf("%v (%v %v)", m.Name, b.Method, b.Path)
+				}
+				folder.Item = append(folder.Item, postmanItem{Name: name, Request: req})
+			}
+		}
+		collection.Item = append(collection.Item, folder)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(collection); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// postmanRequest returns the request for calling md through b. Without a body, the input is sent in the query string
+// with the flat encoding, and fields bound to the path are left out of the sample body.
+func (s *Server) postmanRequest(md *desc.MethodDescriptor, b HTTPBinding, opts PostmanOptions) (*postmanRequest, error) {
+	reqMsg, respMsg := bindingMessages(md, b)
+
+	contentType := fmt.Sprintf(`application/x-protobuf; reqMsg="%v"; respMsg="%v";`, reqMsg.GetFullyQualifiedName(), respMsg.GetFullyQualifiedName())
+	if b.Body == "" {
+		contentType += " qsEncoding=flat;"
+	}
+
+	body, err := s.skeleton(reqMsg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to render skeleton for '%v': %v", reqMsg.GetFullyQualifiedName(), err)
+	}
+	url := postmanURL{Host: []string{"{{baseUrl}}"}, Path: []string{}}
+	var pathFields []string
+	path := pathParam.ReplaceAllStringFunc(b.Path, func(param string) string {
+		m := pathParam.FindStringSubmatch(param)
+		pathFields = append(pathFields, m[1])
+		url.Variable = append(url.Variable, postmanVariable{Key: m[1], Description: m[2]})
+		return ":" + m[1]
+	})
+	if b.Body == "" {
+		body = withoutFields(body, reqMsg, pathFields)
+	}
+	url.Raw = "{{baseUrl}}" + path
+	for _, seg := range strings.Split(path, "/") {
+		if seg != "" {
+			url.Path = append(url.Path, seg)
+		}
+	}
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return nil, err
+	}
+	return &postmanRequest{
+		Method: b.Method,
+		Header: []postmanVariable{{Key: "Content-Type", Value: contentType}},
+		Body: &postmanBody{
+			Mode:    "raw",
+			Raw:     indented.String(),
+			Options: json.RawMessage(`{"raw":{"language":"json"}}`),
+		},
+		URL:         url,
+		Description: comment(md),
+		Proxy:       postmanProxy{Match: "http+https://*/*", Host: opts.ProxyHost, Port: opts.ProxyPort},
+	}, nil
+}
+
+// withoutFields removes the top-level fields of md that are named in names from js.
+func withoutFields(js []byte, md *desc.MessageDescriptor, names []string) []byte {
+	keys, values, err := decodeJSONObject(js)
+	if err != nil || keys == nil {
+		return js
+	}
+	for _, name := range names {
+		if fd := md.FindFieldByName(name); fd != nil {
+			delete(values, fd.GetJSONName())
+		}
+	}
+	return encodeJSONObject(keys, values)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostmanCollection(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"library.proto"})
+	require.NoError(t, err)
+	s := New(Config{FileDescriptors: fds})
+
+	b, err := s.PostmanCollection(PostmanOptions{Name: "Library", BaseURL: "http://localhost:8080", ProxyHost: "localhost", ProxyPort: 7777})
+	require.NoError(t, err)
+	var collection postmanCollection
+	require.NoError(t, json.Unmarshal(b, &collection))
+
+	assert.Equal(t, "Library", collection.Info.Name)
+	assert.Equal(t, postmanSchema, collection.Info.Schema)
+	assert.Equal(t, []postmanVariable{{Key: "baseUrl", Value: "http://localhost:8080"}}, collection.Variable)
+	require.Len(t, collection.Item, 1)
+	folder := collection.Item[0]
+	assert.Equal(t, "fixtures.Library", folder.Name)
+	assert.Equal(t, "Library manages books.", folder.Description)
+
+	requests := map[string]*postmanRequest{}
+	for _, item := range folder.Item {
+		requests[item.Name] = item.Request
+	}
+	assert.Len(t, requests, 5, "streaming methods are left out")
+
+	tests := []struct {
+		name        string
+		method      string
+		url         string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "GetBook",
+			method:      "GET",
+			url:         "{{baseUrl}}/v1/:name",
+			contentType: `application/x-protobuf; reqMsg="fixtures.GetBookRequest"; respMsg="fixtures.Book"; qsEncoding=flat;`,
+			body:        `{}`,
+		},
+		{
+			name:        "CreateBook",
+			method:      "POST",
+			url:         "{{baseUrl}}/v1/:parent/books",
+			contentType: `application/x-protobuf; reqMsg="fixtures.Book"; respMsg="fixtures.Book";`,
+			body:        `{"name":"","title":""}`,
+		},
+		{
+			name:        "CreateBook (PUT /v1/{parent=shelves/*}/books)",
+			method:      "PUT",
+			url:         "{{baseUrl}}/v1/:parent/books",
+			contentType: `application/x-protobuf; reqMsg="fixtures.CreateBookRequest"; respMsg="fixtures.Book";`,
+			body:        `{"parent":"","book":{"name":"","title":""},"requestId":""}`,
+		},
+		{
+			name:        "ListBooks",
+			method:      "SEARCH",
+			url:         "{{baseUrl}}/v1/books",
+			contentType: `application/x-protobuf; reqMsg="fixtures.ListBooksRequest"; respMsg="fixtures.ListBooksResponse"; qsEncoding=flat;`,
+			body:        `{"pageSize":0}`,
+		},
+		{
+			name:        "DeleteBook",
+			method:      "POST",
+			url:         "{{baseUrl}}/fixtures.Library/DeleteBook",
+			contentType: `application/x-protobuf; reqMsg="fixtures.GetBookRequest"; respMsg="fixtures.Empty";`,
+			body:        `{"name":""}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := requests[tc.name]
+			require.NotNil(t, req)
+			assert.Equal(t, tc.method, req.Method)
+			assert.Equal(t, tc.url, req.URL.Raw)
+			assert.Equal(t, []postmanVariable{{Key: "Content-Type", Value: tc.contentType}}, req.Header)
+			assert.JSONEq(t, tc.body, req.Body.Raw)
+			assert.Equal(t, postmanProxy{Match: "http+https://*/*", Host: "localhost", Port: 7777}, req.Proxy)
+		})
+	}
+
+	t.Run("path variables", func(t *testing.T) {
+		req := requests["GetBook"]
+		assert.Equal(t, []string{"v1", ":name"}, req.URL.Path)
+		assert.Equal(t, []postmanVariable{{Key: "name", Description: "shelves/*/books/*"}}, req.URL.Variable)
+		assert.Equal(t, "GetBook returns a book by name.", req.Description)
+	})
+}
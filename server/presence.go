@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// clearImplicitZeros clears fields without presence that hold their zero value. dynamic.Message only does this for
+// proto3 files, so without it zero values of implicit-presence fields in Editions files would be sent on the wire.
+func clearImplicitZeros(msg *dynamic.Message) {
+	forEachField("", msg, func(_ string, fd *desc.FieldDescriptor, msg *dynamic.Message) {
+		if fd.HasPresence() || fd.IsRepeated() || !msg.HasField(fd) {
+			return
+		}
+		if reflect.DeepEqual(msg.GetField(fd), fd.GetDefaultValue()) {
+			msg.ClearField(fd)
+		}
+	})
+}
+
+// hasExplicitPresence reports whether an unset fd should be left out of JSON responses. Fields with a declared
+// default keep showing it, and unset message fields are already rendered as null. Unset proto2 fields are shown
+// with their zero values, as they always have been.
+func hasExplicitPresence(fd *desc.FieldDescriptor) bool {
+	return fd.HasPresence() && !fd.IsRepeated() && fd.GetMessageType() == nil && !hasExplicitDefault(fd) &&
+		fd.GetFile().UnwrapFile().Syntax() != protoreflect.Proto2
+}
+
+// presence removes unset fields with explicit presence from JSON responses. jsonpb's EmitDefaults renders them as
+// zero values, which hides the difference between an unset field and one explicitly set to zero. It remembers which
+// messages can contain such fields, so that the JSON of the others is returned without being parsed.
+type presence struct {
+	mu    sync.Mutex
+	cache map[*desc.MessageDescriptor]bool
+}
+
+func newPresence() *presence {
+	return &presence{cache: map[*desc.MessageDescriptor]bool{}}
+}
+
+// stripUnsetFields removes unset fields with explicit presence from js, the JSON encoding of msg.
+func (p *presence) stripUnsetFields(js []byte, msg *dynamic.Message) ([]byte, error) {
+	md := msg.GetMessageDescriptor()
+	if !p.hasPresenceFields(md) {
+		return js, nil
+	}
+	keys, values, err := decodeJSONObject(js)
+	if err != nil || keys == nil {
+		return js, err
+	}
+
+	for _, fd := range md.GetFields() {
+		key := fd.GetJSONName()
+		val, ok := values[key]
+		if !ok {
+			continue
+		}
+		if !msg.HasField(fd) {
+			if hasExplicitPresence(fd) {
+				delete(values, key)
+			}
+			continue
+		}
+		if fd.GetMessageType() == nil {
+			continue
+		}
+
+		if values[key], err = transformNestedJSON(val, msg.GetField(fd), p.stripUnsetFields); err != nil {
+			return nil, err
+		}
+	}
+	return encodeJSONObject(keys, values), nil
+}
+
+// hasPresenceFields reports whether md, or any message it contains, has fields with explicit presence.
+func (p *presence) hasPresenceFields(md *desc.MessageDescriptor) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if found, ok := p.cache[md]; ok {
+		return found
+	}
+	found := findPresenceFields(md, map[*desc.MessageDescriptor]bool{})
+	p.cache[md] = found
+	return found
+}
+
+func findPresenceFields(md *desc.MessageDescriptor, seen map[*desc.MessageDescriptor]bool) bool {
+	if seen[md] || strings.HasPrefix(md.GetFullyQualifiedName(), "google.protobuf.") {
+		// Well-known types have their own JSON representation
+		return false
+	}
+	seen[md] = true
+	for _, fd := range md.GetFields() {
+		if hasExplicitPresence(fd) {
+			return true
+		}
+		nested := fd.GetMessageType()
+		if fd.IsMap() {
+			nested = fd.GetMapValueType().GetMessageType()
+		}
+		if nested != nil && findPresenceFields(nested, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// transformNestedJSON applies fn to the JSON of every message in val, the value of a message field, where js is the
+// JSON encoding of val.
+func transformNestedJSON(js []byte, val interface{}, fn func([]byte, *dynamic.Message) ([]byte, error)) ([]byte, error) {
+	switch val := val.(type) {
+	case *dynamic.Message:
+		return fn(js, val)
+	case []interface{}:
+		return transformJSONList(js, val, fn)
+	case map[interface{}]interface{}:
+		return transformJSONMap(js, val, fn)
+	}
+	return js, nil
+}
+
+func transformJSONList(js []byte, list []interface{}, fn func([]byte, *dynamic.Message) ([]byte, error)) ([]byte, error) {
+	var elems []json.RawMessage
+	if err := json.Unmarshal(js, &elems); err != nil || len(elems) != len(list) {
+		return js, err
+	}
+	for i, e := range list {
+		nested, ok := e.(*dynamic.Message)
+		if !ok {
+			return js, nil
+		}
+		b, err := fn(elems[i], nested)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = b
+	}
+	return json.Marshal(elems)
+}
+
+func transformJSONMap(js []byte, m map[interface{}]interface{}, fn func([]byte, *dynamic.Message) ([]byte, error)) ([]byte, error) {
+	keys, values, err := decodeJSONObject(js)
+	if err != nil || keys == nil {
+		return js, err
+	}
+	for k, e := range m {
+		nested, ok := e.(*dynamic.Message)
+		if !ok {
+			return js, nil
+		}
+		key := fmt.Sprint(k)
+		if val, ok := values[key]; ok {
+			if values[key], err = fn(val, nested); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return encodeJSONObject(keys, values), nil
+}
+
+// decodeJSONObject splits a JSON object into its keys, in order, and their raw values.
+// It returns nil keys if js is not an object.
+func decodeJSONObject(js []byte) ([]string, map[string]json.RawMessage, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, nil, nil
+	}
+	keys := []string{}
+	values := map[string]json.RawMessage{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		key, _ := tok.(string)
+		var val json.RawMessage
+		if err := dec.Decode(&val); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		values[key] = val
+	}
+	return keys, values, nil
+}
+
+// encodeJSONObject is the inverse of decodeJSONObject. Keys missing from values are skipped.
+func encodeJSONObject(keys []string, values map[string]json.RawMessage) []byte {
+	buf := bytes.NewBufferString("{")
+	first := true
+	for _, k := range keys {
+		val, ok := values[k]
+		if !ok {
+			continue
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPresence(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"presence.proto", "editions.proto", "legacy.proto"})
+	require.NoError(t, err)
+	findMessage := func(name string) *dynamic.Message {
+		for _, fd := range fds {
+			if md := fd.FindMessage(name); md != nil {
+				return dynamic.NewMessage(md)
+			}
+		}
+		t.Fatalf("message %v not found", name)
+		return nil
+	}
+
+	tests := []struct {
+		name     string
+		msg      string
+		js       string
+		expected string
+	}{
+		{
+			name:     "proto3 optional",
+			msg:      "fixtures.Presence",
+			js:       `{"count":0,"implicit":0}`,
+			expected: `{"implicit":0}`,
+		},
+		{
+			name:     "editions",
+			msg:      "fixtures.editions.Item",
+			js:       `{"count":0,"label":""}`,
+			expected: `{"label":""}`,
+		},
+		{
+			name:     "nested in a recursive message",
+			msg:      "fixtures.PresenceTree",
+			js:       `{"parent":null,"items":{}}`,
+			expected: `{"parent":null,"items":{}}`,
+		},
+		{
+			name:     "proto2 is left as is",
+			msg:      "fixtures.Legacy",
+			js:       `{ "id": "", "plain": 0 }`,
+			expected: `{ "id": "", "plain": 0 }`,
+		},
+	}
+
+	p := newPresence()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := p.stripUnsetFields([]byte(tc.js), findMessage(tc.msg))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(b))
+		})
+	}
+
+	for name, expected := range map[string]bool{
+		"fixtures.Presence":      true,
+		"fixtures.editions.Item": true,
+		"fixtures.PresenceTree":  true,
+		"fixtures.Legacy":        false,
+		"fixtures.Settings":      false,
+	} {
+		assert.Equal(t, expected, p.hasPresenceFields(findMessage(name).GetMessageDescriptor()), name)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// missingRequiredFields returns the path of every proto2 required field that is unset in msg or its nested messages.
+func missingRequiredFields(path string, msg *dynamic.Message) []violation {
+	var violations []violation
+	forEachField(path, msg, func(fieldPath string, fd *desc.FieldDescriptor, msg *dynamic.Message) {
+		if fd.IsRequired() && !msg.HasField(fd) {
+			violations = append(violations, violation{fieldPath, "required", "required field is missing"})
+		}
+	})
+	return violations
+}
+
+// fillDefaults sets every unset proto2 field that declares a [default = ...] value to that value, so upstreams
+// receive it explicitly.
+func fillDefaults(msg *dynamic.Message) {
+	forEachField("", msg, func(_ string, fd *desc.FieldDescriptor, msg *dynamic.Message) {
+		if !hasExplicitDefault(fd) || msg.HasField(fd) || fd.GetOneOf() != nil {
+			return
+		}
+		msg.SetField(fd, fd.GetDefaultValue())
+	})
+}
+
+func hasExplicitDefault(fd *desc.FieldDescriptor) bool {
+	return fd.AsFieldDescriptorProto().DefaultValue != nil
+}
+
+// forEachField calls fn for every field declared in msg and in all of its nested messages that are set.
+func forEachField(path string, msg *dynamic.Message, fn func(path string, fd *desc.FieldDescriptor, msg *dynamic.Message)) {
+	for _, fd := range msg.GetMessageDescriptor().GetFields() {
+		fieldPath := fd.GetName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		fn(fieldPath, fd, msg)
+		if fd.GetMessageType() == nil || !msg.HasField(fd) {
+			continue
+		}
+
+		switch val := msg.GetField(fd).(type) {
+		case map[interface{}]interface{}:
+			for _, k := range sortedMapKeys(val) {
+				if nested, ok := val[k].(*dynamic.Message); ok {
+					forEachField(fmt.Sprintf("%s[%v]", fieldPath, k), nested, fn)
+				}
+			}
+		case []interface{}:
+			for i, e := range val {
+				if nested, ok := e.(*dynamic.Message); ok {
+					forEachField(fmt.Sprintf("%s[%d]", fieldPath, i), nested, fn)
+				}
+			}
+		case *dynamic.Message:
+			forEachField(fieldPath, val, fn)
+		}
+	}
+}
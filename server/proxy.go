@@ -3,64 +3,219 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"mime"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/camgraff/protoxy/log"
+	"github.com/camgraff/protoxy/protoparser"
 
 	"github.com/golang/protobuf/jsonpb"
 	"github.com/golang/protobuf/proto"
 	"github.com/jhump/protoreflect/desc"
 	"github.com/jhump/protoreflect/dynamic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Server is the base type for our proxy.
 type Server struct {
-	Port            uint16
-	FileDescriptors []*desc.FileDescriptor
+	Port                uint16
+	FileDescriptors     []*desc.FileDescriptor
+	RawFallback         bool
+	FillDefaults        bool
+	ResponseHeaders     map[string]string
+	DecodedHeaderCopies bool
+	Transport           TransportConfig
+	Upstreams           map[string]TransportConfig
+	MaxRequestBytes     int64
+	MaxResponseBytes    int64
+	PassLargeBodies     bool
+	LogPayloads         bool
+
+	metrics     *metrics
+	tracer      trace.Tracer
+	anyResolver jsonpb.AnyResolver
+	validator   *validator
+	redactor    *redactor
+	presence    *presence
+	httpRules   *optionsParser
+	transport   *transport
+	proxy       *httputil.ReverseProxy
+	caller      *caller
 }
 
 // Config holds the configuration for our server.
 type Config struct {
 	FileDescriptors []*desc.FileDescriptor
 	Port            uint16
+	// RawFallback enables schema-less conversion of bodies whose message type is missing or unknown.
+	RawFallback bool
+	// FillDefaults sets unset proto2 fields to their declared default values before forwarding requests.
+	FillDefaults bool
+	// ResponseHeaders maps response header and trailer names to the message type of their base64 protobuf value.
+	// Those headers are converted to JSON.
+	ResponseHeaders map[string]string
+	// DecodedHeaderCopies keeps the original response headers and adds the JSON under X-Protoxy-Decoded-<name>.
+	DecodedHeaderCopies bool
+	// Validate enables checking request messages against their protoc-gen-validate or protovalidate rules.
+	Validate bool
+	// Transport holds the timeouts, connection pool sizes and retry policy for upstream requests.
+	Transport TransportConfig
+	// Upstreams replaces Transport for requests to some upstreams. Keys are a host and port, such as
+	// api.example.com:8443, or just a host to match any port. Connection pool sizes always come from Transport.
+	Upstreams map[string]TransportConfig
+	// MaxRequestBytes limits the size of request bodies that are converted. 0 means no limit.
+	MaxRequestBytes int64
+	// MaxResponseBytes limits the size of response bodies that are converted. 0 means no limit.
+	MaxResponseBytes int64
+	// PassLargeBodies forwards bodies over the size limits unconverted, instead of failing with a 413 or 502.
+	PassLargeBodies bool
+	// LogPayloads dumps decoded request and response payloads at debug level, with redacted fields masked.
+	LogPayloads bool
+	// RedactOptions are custom bool field options, such as acme.sensitive, that mark fields to mask in payload dumps.
+	// Fields marked with debug_redact are always masked.
+	RedactOptions []string
+	// RedactFields are the fully-qualified names of more fields to mask in payload dumps, such as
+	// example.Login.password.
+	RedactFields []string
+	// TracerProvider creates the spans for proxied requests. Defaults to the global provider.
+	TracerProvider trace.TracerProvider
 }
 
 // protoTypes are used to determine the message types used to convert data in the request and response bodies.
 type protoTypes struct {
-	requestMessage   string
-	responseMessages []string
-	queryStringParam string
+	requestMessage      string
+	responseMessages    []string
+	queryStringParam    string
+	queryStringEncoding string
+	bodyHeader          string
+	headerMessages      []headerMessage
+	mediaType           string
+	boundary            string
+	compression         string
+}
+
+type contextKey int
+
+const requestStateKey contextKey = iota
+
+// requestState is the per-request state the shared ReverseProxy needs. It is carried in the request context.
+type requestState struct {
+	upstream         string
+	transport        TransportConfig
+	responseMessages []*desc.MessageDescriptor
+
+	// Used for metrics. Only configured upstreams and resolved message names are used as labels, so clients can't
+	// create new series.
+	host            string
+	requestMessage  string
+	responseMessage string
+	outcome         string
+}
+
+// requestStateFrom returns the requestState stored in ctx, or nil if there is none.
+func requestStateFrom(ctx context.Context) *requestState {
+	state, _ := ctx.Value(requestStateKey).(*requestState)
+	return state
 }
 
 // New returns a new proxy server instance
 func New(cfg Config) *Server {
-	return &Server{
-		Port:            cfg.Port,
-		FileDescriptors: cfg.FileDescriptors,
+	// Any fields may hold messages from any loaded file, or one of the well-known types.
+	files := append([]*desc.FileDescriptor{}, cfg.FileDescriptors...)
+	wkts, err := protoparser.WellKnownTypes()
+	if err != nil {
+		log.Log.WithError(err).Warn("unable to load well-known types")
+	}
+	files = append(files, wkts...)
+
+	s := &Server{
+		Port:                cfg.Port,
+		FileDescriptors:     cfg.FileDescriptors,
+		RawFallback:         cfg.RawFallback,
+		FillDefaults:        cfg.FillDefaults,
+		ResponseHeaders:     cfg.ResponseHeaders,
+		DecodedHeaderCopies: cfg.DecodedHeaderCopies,
+		Transport:           cfg.Transport,
+		Upstreams:           cfg.Upstreams,
+		MaxRequestBytes:     cfg.MaxRequestBytes,
+		MaxResponseBytes:    cfg.MaxResponseBytes,
+		PassLargeBodies:     cfg.PassLargeBodies,
+		LogPayloads:         cfg.LogPayloads,
+		anyResolver:         dynamic.AnyResolver(nil, files...),
+		metrics:             newMetrics(),
+		presence:            newPresence(),
+		tracer:              newTracer(cfg.TracerProvider),
+		caller:              &caller{},
+	}
+	s.transport = newTransport(cfg.Transport, cfg.Upstreams, s.tracer)
+	s.metrics.schemaLoaded(cfg.FileDescriptors)
+	s.proxy = s.newReverseProxy()
+	s.redactor = newRedactor(cfg.FileDescriptors, s.anyResolver, cfg.RedactOptions, cfg.RedactFields)
+	s.httpRules, err = newOptionsParser(cfg.FileDescriptors, "google.protobuf.MethodOptions", map[string]bool{httpRuleOption: true})
+	if err != nil {
+		log.Log.WithError(err).Warn("unable to load google.api.http options")
+		s.httpRules = &optionsParser{}
+	}
+	if cfg.Validate {
+		s.validator, err = newValidator(cfg.FileDescriptors)
+		if err != nil {
+			log.Log.WithError(err).Error("unable to load validation rules, requests will not be validated")
+		}
+	}
+	return s
+}
+
+// newReverseProxy returns the ReverseProxy that forwards converted requests through s.transport.
+func (s *Server) newReverseProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		// Requests are sent to the URL they were proxied with
+		Director:       func(*http.Request) {},
+		Transport:      s.transport,
+		ModifyResponse: s.modifyResponse,
+		ErrorHandler:   s.handleProxyError,
 	}
 }
 
 func parseMessageTypes(r *http.Request) (ptypes protoTypes, err error) {
 	ctype := r.Header.Get("Content-Type")
-	_, params, err := mime.ParseMediaType(ctype)
+	mediaType, params, err := mime.ParseMediaType(ctype)
 	if err != nil {
 		return ptypes, err
 	}
 	// respmsg can contain multiple response types
-	dstMsgs := strings.Split(params["respmsg"], ",")
+	var dstMsgs []string
+	for _, m := range strings.Split(params["respmsg"], ",") {
+		if m != "" {
+			dstMsgs = append(dstMsgs, m)
+		}
+	}
+	bodyHeader, headerMsgs, err := parseHeaderParam(params["hdr"])
+	if err != nil {
+		return ptypes, err
+	}
 	return protoTypes{
-		requestMessage:   params["reqmsg"],
-		responseMessages: dstMsgs,
-		queryStringParam: params["qs"],
+		requestMessage:      params["reqmsg"],
+		responseMessages:    dstMsgs,
+		queryStringParam:    params["qs"],
+		queryStringEncoding: strings.ToLower(params["qsencoding"]),
+		bodyHeader:          bodyHeader,
+		headerMessages:      headerMsgs,
+		mediaType:           mediaType,
+		boundary:            params["boundary"],
+		compression:         params["compress"],
 	}, nil
 }
 
@@ -70,30 +225,102 @@ func writeErrorResponse(w http.ResponseWriter, status int) {
 	w.Write([]byte("Protoxy was unable to successfully proxy the request. See logs for details."))
 }
 
-func jsonBodyToProto(r *http.Request, msgDescriptor *desc.MessageDescriptor, qsParam string) error {
+// writeConversionErrorResponse responds to a request that could not be converted to protobuf. Validation errors
+// are reported as JSON, so clients can see which fields are invalid.
+func writeConversionErrorResponse(w http.ResponseWriter, err error) {
+	var verr *validationError
+	if !errors.As(err, &verr) {
+		writeErrorResponse(w, http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(verr)
+}
+
+// jsonToProto converts js to the binary encoding of the message described by msgDescriptor. Missing required fields
+// and validation failures are returned as a *validationError.
+func (s *Server) jsonToProto(ctx context.Context, js []byte, msgDescriptor *desc.MessageDescriptor) (*dynamic.Message, []byte, error) {
+	logger := log.FromContext(ctx)
+	// Unmarshal without checking required fields, so that all missing fields can be reported at once
 	msg := dynamic.NewMessage(msgDescriptor)
-	err := jsonpb.Unmarshal(r.Body, msg)
+	unmarshaler := jsonpb.Unmarshaler{AnyResolver: s.anyResolver}
+	err := msg.UnmarshalMergeJSONPB(&unmarshaler, js)
 	if err != nil {
-		log.Log.WithError(err).Error("unable to unmarshal into json")
-		return fmt.Errorf("Unable to unmarshal into json: %v", err)
+		logger.WithError(err).Error("unable to unmarshal into json")
+		return nil, nil, fmt.Errorf("Unable to unmarshal into json: %v", err)
 	}
 
-	reqBytes, err := proto.Marshal(msg)
+	violations := missingRequiredFields("", msg)
+	if s.validator != nil {
+		violations = append(violations, s.validator.validateMessage("", msg)...)
+	}
+	if len(violations) > 0 {
+		err = &validationError{Violations: violations}
+		logger.WithError(err).Error("request message failed validation")
+		return nil, nil, err
+	}
+
+	if s.FillDefaults {
+		fillDefaults(msg)
+	}
+	clearImplicitZeros(msg)
+
+	b, err := proto.Marshal(msg)
 	if err != nil {
-		log.Log.WithError(err).Error("unable to marshal message")
-		return fmt.Errorf("Unable to marshal message: %v", err)
+		logger.WithError(err).Error("unable to marshal message")
+		return nil, nil, fmt.Errorf("Unable to marshal message: %v", err)
 	}
+	return msg, b, nil
+}
 
-	// If qs was specified, encode the proto bytes and append to url
-	if qsParam != "" {
-		b64bytes := base64.URLEncoding.EncodeToString(reqBytes)
-		urlstr := r.URL.String() + "?" + qsParam + "=" + b64bytes
-		newurl, err := url.Parse(urlstr)
+// jsonBodyToProto converts the JSON request body to protobuf. If msgDescriptor is nil, the body is encoded
+// without a schema and must be a JSON object keyed by field number.
+func (s *Server) jsonBodyToProto(r *http.Request, msgDescriptor *desc.MessageDescriptor, ptypes protoTypes) error {
+	logger := log.FromContext(r.Context())
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		logger.WithError(err).Error("unable to read request body")
+		return fmt.Errorf("Unable to read request body: %v", err)
+	}
+
+	var reqBytes []byte
+	var msg *dynamic.Message
+	if msgDescriptor == nil {
+		// Only JSON objects can be encoded without a schema. Anything else, such as a body that is already protobuf,
+		// is passed through.
+		if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '{' || !json.Valid(trimmed) {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			return nil
+		}
+		reqBytes, err = encodeRawJSON(bytes.NewReader(body))
 		if err != nil {
-			log.Log.WithError(err).Error("error parsing url string")
-			return fmt.Errorf("Error parsing url string: %v", err)
+			logger.WithError(err).Error("unable to encode raw json")
+			return fmt.Errorf("Unable to encode raw json: %v", err)
 		}
-		r.URL = newurl
+	} else {
+		msg, reqBytes, err = s.jsonToProto(r.Context(), body, msgDescriptor)
+		if err != nil {
+			return err
+		}
+		s.dumpPayload(logger, "request", msg)
+	}
+
+	// If qs was specified, encode the proto into the query string instead of the body
+	if ptypes.queryStringParam != "" || ptypes.queryStringEncoding == qsEncodingFlat {
+		if err = encodeQueryString(r.URL, msg, reqBytes, ptypes.queryStringParam, ptypes.queryStringEncoding); err != nil {
+			logger.WithError(err).Error("error encoding query string")
+			return fmt.Errorf("Error encoding query string: %v", err)
+		}
+		r.Body = http.NoBody
+		r.ContentLength = 0
+		return nil
+	}
+
+	// If hdr names a header for the body, send the proto there instead of the body
+	if ptypes.bodyHeader != "" {
+		r.Header.Set(ptypes.bodyHeader, base64.StdEncoding.EncodeToString(reqBytes))
+		r.Body = http.NoBody
 		r.ContentLength = 0
 		return nil
 	}
@@ -105,7 +332,21 @@ func jsonBodyToProto(r *http.Request, msgDescriptor *desc.MessageDescriptor, qsP
 	return nil
 }
 
-func (s *Server) findMessageDescriptors(reqMsg string, respMsgs []string) (reqMsgDesc *desc.MessageDescriptor, respMsgDescs []*desc.MessageDescriptor, err error) {
+// protoToJSON renders msg as JSON. Unset fields are shown with their default values, except for fields with explicit
+// presence.
+func (s *Server) protoToJSON(msg *dynamic.Message) ([]byte, error) {
+	marshaler := jsonpb.Marshaler{
+		EmitDefaults: true,
+		AnyResolver:  s.anyResolver,
+	}
+	js, err := marshaler.MarshalToString(msg)
+	if err != nil {
+		return nil, err
+	}
+	return s.presence.stripUnsetFields([]byte(js), msg)
+}
+
+func (s *Server) findMessageDescriptors(ctx context.Context, reqMsg string, respMsgs []string) (reqMsgDesc *desc.MessageDescriptor, respMsgDescs []*desc.MessageDescriptor, err error) {
 	for _, fd := range s.FileDescriptors {
 		if reqMsgDesc == nil {
 			reqMsgDesc = fd.FindMessage(reqMsg)
@@ -122,99 +363,343 @@ func (s *Server) findMessageDescriptors(reqMsg string, respMsgs []string) (reqMs
 	if reqMsg != "" && reqMsgDesc == nil {
 		errMsg += fmt.Sprintf("Failed to find message descriptor for '%v'. ", reqMsg)
 	}
-	if len(respMsgs) > 0 && len(respMsgDescs) == 0 {
+	if len(respMsgs) == 0 {
+		errMsg += "No response message types were given."
+	} else if len(respMsgDescs) == 0 {
 		errMsg += fmt.Sprintf("Failed to find any message descriptors for '%v'.", respMsgs)
 	}
 	if errMsg != "" {
-		log.Log.WithField("err", errMsg).Error("failed to find message descriptors")
-		return nil, nil, errors.New(errMsg)
+		log.FromContext(ctx).WithField("err", errMsg).Error("failed to find message descriptors")
+		return reqMsgDesc, respMsgDescs, errors.New(errMsg)
 	}
 	return reqMsgDesc, respMsgDescs, nil
 }
 
 func (s *Server) proxyRequest(w http.ResponseWriter, r *http.Request) {
-	msgTypes, err := parseMessageTypes(r)
+	state := &requestState{host: otherHostLabel, outcome: outcomeOK}
+	defer s.metrics.observe(state, time.Now())
+
+	// Propagate the client's request ID upstream and back, or generate one
+	requestID := r.Header.Get(requestIDHeader)
+	if requestID == "" {
+		requestID = newRequestID()
+		r.Header.Set(requestIDHeader, requestID)
+	}
+	w.Header().Set(requestIDHeader, requestID)
+	logger := log.Log.WithField("request_id", requestID)
+	ctx := log.NewContext(r.Context(), logger)
+
+	// Continue the trace of the client, if any
+	ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	ctx, span := s.tracer.Start(ctx, "protoxy.proxy", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", r.Method),
+		attribute.String("server.address", r.URL.Host),
+		attribute.String("protoxy.request_id", requestID),
+	))
+	defer endProxySpan(span, state)
+	r = r.WithContext(ctx)
+
+	upstream, upstreamCfg := s.upstream(r.URL)
+	if upstream != "" {
+		state.host = upstream
+	}
+	transportCfg, err := parseTransportOverrides(r.Header, upstreamCfg)
 	if err != nil {
-		log.Log.WithError(err).Error("error parsing message types")
+		state.outcome = outcomeParse
+		logger.WithError(err).Error("error parsing transport overrides")
 		writeErrorResponse(w, http.StatusBadRequest)
 		return
 	}
 
-	reqMsgDesc, respMsgDescs, err := s.findMessageDescriptors(msgTypes.requestMessage, msgTypes.responseMessages)
+	msgTypes, err := parseMessageTypes(r)
 	if err != nil {
-		log.Log.WithError(err).Error("error finding message descriptors")
+		state.outcome = outcomeParse
+		logger.WithError(err).Error("error parsing message types")
 		writeErrorResponse(w, http.StatusBadRequest)
 		return
 	}
+	span.SetAttributes(
+		attribute.String("protoxy.request_message", msgTypes.requestMessage),
+		attribute.StringSlice("protoxy.response_messages", msgTypes.responseMessages),
+	)
 
-	if reqMsgDesc != nil {
-		if err = jsonBodyToProto(r, reqMsgDesc, msgTypes.queryStringParam); err != nil {
-			log.Log.WithError(err).Error("error converting JSON body to proto")
+	reqMsgDesc, respMsgDescs, err := s.findMessageDescriptors(ctx, msgTypes.requestMessage, msgTypes.responseMessages)
+	state.requestMessage, state.responseMessage = messageLabels(msgTypes, reqMsgDesc, respMsgDescs)
+	if err != nil {
+		if !s.RawFallback {
+			state.outcome = outcomeLookup
+			logger.WithError(err).Error("error finding message descriptors")
 			writeErrorResponse(w, http.StatusBadRequest)
 			return
 		}
+		logger.WithError(err).Warn("falling back to raw protobuf conversion")
 	}
 
-	// Override content-type to remove params
-	r.Header.Set("Content-Type", "application/x-protobuf")
+	if !s.encodeRequest(w, r, state, msgTypes, reqMsgDesc) {
+		return
+	}
 
-	modifyResp := func(r *http.Response) error {
-		body, err := ioutil.ReadAll(r.Body)
-		if err != nil {
-			return fmt.Errorf("Failed to read response body: %v", err)
+	state.upstream = upstream
+	state.transport = transportCfg
+	state.responseMessages = respMsgDescs
+	s.proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestStateKey, state)))
+}
+
+// encodeRequest converts the JSON in the body and headers of r to protobuf. If the request cannot be converted, it
+// writes an error response and returns false.
+func (s *Server) encodeRequest(w http.ResponseWriter, r *http.Request, state *requestState, msgTypes protoTypes, reqMsgDesc *desc.MessageDescriptor) bool {
+	logger := log.FromContext(r.Context())
+	_, span := s.tracer.Start(r.Context(), "protoxy.encode", trace.WithAttributes(
+		attribute.String("protoxy.request_message", msgTypes.requestMessage),
+	))
+	defer span.End()
+	defer func() {
+		if state.outcome == outcomeEncode {
+			span.SetStatus(codes.Error, "unable to convert request")
 		}
-		err = r.Body.Close()
-		if err != nil {
-			return fmt.Errorf("Error closing body: %v", err)
-		}
-		// Try all possible responses until something works
-		var errs error
-		var msg proto.Message
-		for _, d := range respMsgDescs {
-			msg = dynamic.NewMessage(d)
-			err = proto.Unmarshal(body, msg)
-			if err != nil {
-				errs = fmt.Errorf("Unable to unmarshal into json: %v", err)
-			} else {
-				errs = nil
-				break
+	}()
+
+	requestTooLarge := false
+	if err := s.limitRequestBody(r); err != nil {
+		if !errors.Is(err, errBodyTooLarge) {
+			state.outcome = outcomeEncode
+			logger.WithError(err).Error("error reading request body")
+			writeErrorResponse(w, http.StatusBadRequest)
+			return false
+		}
+		if !s.PassLargeBodies {
+			state.outcome = outcomeEncode
+			logger.WithField("limit", s.MaxRequestBytes).Error("request body is too large to convert")
+			writeBodyTooLargeResponse(w, http.StatusRequestEntityTooLarge, "request", s.MaxRequestBytes)
+			return false
+		}
+		logger.WithField("limit", s.MaxRequestBytes).Warn("request body is too large to convert, forwarding it unconverted")
+		span.SetAttributes(attribute.Bool("protoxy.request.passed_through", true))
+		requestTooLarge = true
+	}
+	if r.ContentLength >= 0 {
+		span.SetAttributes(attribute.Int64("protoxy.request.size", r.ContentLength))
+	}
+
+	if err := s.encodeHeaderMessages(r, msgTypes.headerMessages); err != nil {
+		state.outcome = outcomeEncode
+		logger.WithError(err).Error("error converting JSON headers to proto")
+		writeConversionErrorResponse(w, err)
+		return false
+	}
+
+	switch {
+	case requestTooLarge:
+		// Forward the body as it was sent, without protoxy's params
+		r.Header.Set("Content-Type", msgTypes.mediaType)
+	case isMultipart(msgTypes.mediaType):
+		if err := s.encodeMultipart(r, msgTypes); err != nil {
+			state.outcome = outcomeEncode
+			logger.WithError(err).Error("error converting multipart body to proto")
+			writeConversionErrorResponse(w, err)
+			return false
+		}
+		// Override content-type to remove params, except for the boundary
+		r.Header.Set("Content-Type", mime.FormatMediaType(msgTypes.mediaType, map[string]string{"boundary": msgTypes.boundary}))
+	default:
+		if reqMsgDesc != nil || s.RawFallback {
+			if err := s.jsonBodyToProto(r, reqMsgDesc, msgTypes); err != nil {
+				state.outcome = outcomeEncode
+				logger.WithError(err).Error("error converting JSON body to proto")
+				writeConversionErrorResponse(w, err)
+				return false
 			}
 		}
-		if errs != nil {
-			return errs
+
+		// Override content-type to remove params
+		r.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	if !requestTooLarge {
+		if err := compressRequestBody(r, msgTypes.compression); err != nil {
+			state.outcome = outcomeEncode
+			logger.WithError(err).Error("error compressing request body")
+			writeErrorResponse(w, http.StatusBadRequest)
+			return false
 		}
+	}
+
+	if r.ContentLength >= 0 {
+		span.SetAttributes(attribute.Int64("protoxy.request.encoded_size", r.ContentLength))
+	}
+	return true
+}
+
+// modifyResponse converts the protobuf response body to JSON, using the response message types of the request.
+func (s *Server) modifyResponse(r *http.Response) error {
+	ctx, span := s.tracer.Start(r.Request.Context(), "protoxy.decode")
+	defer span.End()
+
+	state := requestStateFrom(ctx)
+	if err := s.convertResponse(ctx, r, state.responseMessages); err != nil {
+		state.outcome = outcomeDecode
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "unable to convert response")
+		return err
+	}
+	return nil
+}
 
-		marshaler := jsonpb.Marshaler{
-			EmitDefaults: true,
+func (s *Server) convertResponse(ctx context.Context, r *http.Response, respMsgDescs []*desc.MessageDescriptor) error {
+	logger := log.FromContext(ctx)
+	span := trace.SpanFromContext(ctx)
+	body, overflow, err := readLimited(r.Body, r.ContentLength, s.MaxResponseBytes)
+	if overflow != nil {
+		if !s.PassLargeBodies {
+			return fmt.Errorf("Unable to convert response: %w", err)
 		}
-		buf := bytes.NewBuffer(nil)
-		err = marshaler.Marshal(buf, msg)
-		if err != nil {
-			return fmt.Errorf("Failed to marshal response: %v", err)
+		logger.WithField("limit", s.MaxResponseBytes).Warn("response body is too large to convert, forwarding it unconverted")
+		span.SetAttributes(attribute.Bool("protoxy.response.passed_through", true))
+		r.Body = overflow
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read response body: %v", err)
+	}
+
+	// The converted body is always sent uncompressed. The limit applies to the decompressed body too, so a small
+	// compressed body can't expand past it.
+	decompressed, err := decompress(r.Header.Get("Content-Encoding"), body, s.MaxResponseBytes)
+	if errors.Is(err, errBodyTooLarge) {
+		if !s.PassLargeBodies {
+			return fmt.Errorf("Unable to convert response: %w", err)
 		}
-		r.Body = ioutil.NopCloser(buf)
-		r.ContentLength = int64(buf.Len())
-		r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
-		r.Header.Set("Content-Type", "application/json")
+		logger.WithField("limit", s.MaxResponseBytes).Warn("decompressed response body is too large to convert, forwarding it unconverted")
+		span.SetAttributes(attribute.Bool("protoxy.response.passed_through", true))
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
 		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("Unable to decompress response body: %v", err)
+	}
+	body = decompressed
+	r.Header.Del("Content-Encoding")
 
-	errorHandler := func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Log.WithError(err).Error("unable to proxy response from server")
-		writeErrorResponse(w, http.StatusBadRequest)
+	// Trailers are only available once the body has been read
+	s.decodeResponseHeaders(ctx, r.Header)
+	s.decodeResponseHeaders(ctx, r.Trailer)
+	span.SetAttributes(attribute.Int("protoxy.response.size", len(body)))
+
+	if len(respMsgDescs) == 0 && s.RawFallback {
+		return writeRawResponse(r, body)
 	}
 
-	proxy := &httputil.ReverseProxy{
-		Director:       func(*http.Request) {},
-		ModifyResponse: modifyResp,
-		ErrorHandler:   errorHandler,
+	// Try all possible responses until something works
+	msg, errs := unmarshalFirst(body, respMsgDescs)
+	if errs != nil {
+		if s.RawFallback {
+			logger.WithError(errs).Warn("falling back to raw protobuf conversion")
+			return writeRawResponse(r, body)
+		}
+		return errs
 	}
 
-	proxy.ServeHTTP(w, r)
+	b, err := s.protoToJSON(msg)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal response: %v", err)
+	}
+	s.dumpPayload(logger, "response", msg)
+	span.SetAttributes(
+		attribute.String("protoxy.response_message", msg.GetMessageDescriptor().GetFullyQualifiedName()),
+		attribute.Int("protoxy.response.decoded_size", len(b)),
+	)
+	buf := bytes.NewBuffer(b)
+	r.Body = ioutil.NopCloser(buf)
+	r.ContentLength = int64(buf.Len())
+	r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	r.Header.Set("Content-Type", "application/json")
+	return nil
 }
 
+func (s *Server) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.FromContext(r.Context()).WithError(err).Error("unable to proxy response from server")
+	// Errors from modifyResponse have already set the outcome
+	if state := requestStateFrom(r.Context()); state != nil && state.outcome == outcomeOK {
+		state.outcome = outcomeUpstream
+	}
+	if errors.Is(err, errBodyTooLarge) {
+		writeBodyTooLargeResponse(w, http.StatusBadGateway, "response", s.MaxResponseBytes)
+		return
+	}
+	writeErrorResponse(w, http.StatusBadRequest)
+}
+
+// unmarshalFirst unmarshals b into the first message type in descs that it is valid for.
+func unmarshalFirst(b []byte, descs []*desc.MessageDescriptor) (*dynamic.Message, error) {
+	var errs error
+	for _, d := range descs {
+		msg := dynamic.NewMessage(d)
+		if err := proto.Unmarshal(b, msg); err != nil {
+			errs = fmt.Errorf("Unable to unmarshal into json: %v", err)
+			continue
+		}
+		return msg, nil
+	}
+	return nil, errs
+}
+
+// writeRawResponse replaces the response body with a schema-less JSON decoding of body.
+func writeRawResponse(r *http.Response, body []byte) error {
+	b, err := decodeRawJSON(body)
+	if err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(b)
+	r.Body = ioutil.NopCloser(buf)
+	r.ContentLength = int64(buf.Len())
+	r.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	r.Header.Set("Content-Type", "application/json")
+	return nil
+}
+
+// shutdownTimeout is how long Serve waits for requests in flight to finish after its context is done.
+const shutdownTimeout = 10 * time.Second
+
 // Run starts the proxy server.
 func (s *Server) Run() {
-	http.HandleFunc("/", s.proxyRequest)
-	log.Log.Fatal(http.ListenAndServe(":"+strconv.Itoa(int(s.Port)), nil))
+	log.Log.Fatal(s.Serve(context.Background()))
+}
+
+// Serve runs the proxy server until ctx is done, then shuts it down gracefully. It returns nil after a graceful
+// shutdown.
+func (s *Server) Serve(ctx context.Context) error {
+	httpServer := &http.Server{Addr: ":" + strconv.Itoa(int(s.Port)), Handler: s.Handler()}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	log.Log.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := httpServer.Shutdown(shutdownCtx)
+	s.transport.closeIdleConnections()
+	if err != nil {
+		return fmt.Errorf("Unable to shut down gracefully: %w", err)
+	}
+	return nil
+}
+
+// Handler returns the http.Handler that serves protoxy. Requests with an absolute URL are proxied. Requests
+// addressed to protoxy itself are served its own endpoints, such as /metrics.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() {
+			s.proxyRequest(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
 }
@@ -1,14 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
+	"encoding/hex"
 	"io/ioutil"
 	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/camgraff/protoxy/internal/moreprotos"
 	"github.com/camgraff/protoxy/internal/testprotos"
@@ -64,6 +72,16 @@ func newMultRespBackend(t *testing.T, resp1 proto.Message, resp2 proto.Message)
 	}))
 }
 
+// newEchoBackend responds with the request body, so the request and response message types are the same.
+func newEchoBackend(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assertHeaderParamsHaveBeenStripped(t, r)
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		w.Write(body)
+	}))
+}
+
 func assertHeaderParamsHaveBeenStripped(t *testing.T, r *http.Request) {
 	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
 	require.NoError(t, err)
@@ -235,7 +253,7 @@ func TestProxy(t *testing.T) {
 			req := httptest.NewRequest("GET", tc.backend.URL, strings.NewReader(tc.reqBody))
 			req.Header.Add("Content-Type", tc.reqHeader)
 			respRecorder := httptest.NewRecorder()
-			srv := New(Config{fds, 7777})
+			srv := New(Config{FileDescriptors: fds, Port: 7777})
 			srv.proxyRequest(respRecorder, req)
 
 			// Verify response
@@ -261,7 +279,7 @@ func TestProxy(t *testing.T) {
 		req := httptest.NewRequest("GET", backend.URL, nil)
 		req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
 		respRecorder := httptest.NewRecorder()
-		srv := New(Config{fds, 7777})
+		srv := New(Config{FileDescriptors: fds, Port: 7777})
 		srv.proxyRequest(respRecorder, req)
 
 		// Verify response
@@ -271,4 +289,723 @@ func TestProxy(t *testing.T) {
 		assert.Equal(t, `{"text":""}`, string(body))
 	})
 
+	t.Run("raw fallback", func(t *testing.T) {
+		resp := &testprotos.Resp{Text: "This is a response"}
+		backend := newBackend(t, &testprotos.Req{}, resp, false)
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		for _, header := range []string{"application/x-protobuf", "application/x-protobuf; reqMsg=testprotos.DoesntExist; respMsg=testprotos.DoesntExist"} {
+			req := httptest.NewRequest("GET", backend.URL, strings.NewReader(`{"1":"some text","2":123,"3":["this","is","a","list"]}`))
+			req.Header.Add("Content-Type", header)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds, Port: 7777, RawFallback: true})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, 200, respRecorder.Code)
+			body, err := ioutil.ReadAll(respRecorder.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, `{"1":"This is a response"}`, string(body))
+		}
+	})
+
+	t.Run("raw fallback passes through bodies that aren't JSON objects", func(t *testing.T) {
+		reqBody, err := proto.Marshal(&testprotos.Req{Text: "already protobuf"})
+		require.NoError(t, err)
+		for _, body := range [][]byte{reqBody, []byte(`["not","an","object"]`), []byte(`{not json`)} {
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, body, received)
+				resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+				require.NoError(t, err)
+				w.Write(resp)
+			}))
+
+			req := httptest.NewRequest("POST", backend.URL, bytes.NewReader(body))
+			req.Header.Add("Content-Type", "application/x-protobuf")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{RawFallback: true})
+			srv.proxyRequest(respRecorder, req)
+			backend.Close()
+
+			assert.Equal(t, 200, respRecorder.Code)
+			assert.Equal(t, `{"1":"This is a response"}`, respRecorder.Body.String())
+		}
+	})
+
+	t.Run("well-known types and any", func(t *testing.T) {
+		backend := newEchoBackend(t)
+		defer backend.Close()
+
+		// payload.proto is not imported by wellknown.proto, so the Any can only be resolved through the loaded files.
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"wellknown.proto", "payload.proto"})
+		require.NoError(t, err)
+
+		reqBody := `{"any":{"@type":"type.googleapis.com/fixtures.Payload","text":"some text","number":22},"struct":{"key":["value",1]},"timestamp":"2020-10-01T12:00:00Z","duration":"1.500s"}`
+		req := httptest.NewRequest("GET", backend.URL, strings.NewReader(reqBody))
+		req.Header.Add("Content-Type", "application/x-protobuf; reqMsg=fixtures.WellKnown; respMsg=fixtures.WellKnown")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds, Port: 7777})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, 200, respRecorder.Code)
+		body, err := ioutil.ReadAll(respRecorder.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, reqBody, string(body))
+	})
+
+	t.Run("validation errors are reported", func(t *testing.T) {
+		backend := newEchoBackend(t)
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"validated.proto"})
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", backend.URL, strings.NewReader(`{"name":"alice","child":{"id":"123e4567-e89b-12d3-a456-426614174000"}}`))
+		req.Header.Add("Content-Type", "application/x-protobuf; reqMsg=fixtures.Validated; respMsg=fixtures.Validated")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds, Port: 7777, Validate: true})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		assert.Equal(t, "application/json", respRecorder.Header().Get("Content-Type"))
+		body, err := ioutil.ReadAll(respRecorder.Body)
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"violations":[{"field":"email","rule":"required","message":"value is required"}]}`, string(body))
+	})
+
+	t.Run("proto2 required fields and defaults", func(t *testing.T) {
+		backend := newEchoBackend(t)
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"legacy.proto"})
+		require.NoError(t, err)
+
+		tt := []struct {
+			name               string
+			cfg                Config
+			reqBody            string
+			reqHeader          string
+			expectedRespBody   string
+			expectedStatusCode int
+		}{
+			{
+				name:               "missing required fields are listed",
+				reqBody:            `{"settings":{},"history":[{"enabled":true},{}],"zones":{"c":{},"a":{},"b":{"enabled":true},"d":{}}}`,
+				reqHeader:          "application/x-protobuf; reqMsg=fixtures.Legacy; respMsg=fixtures.Legacy",
+				expectedRespBody:   `{"violations":[{"field":"id","rule":"required","message":"required field is missing"},{"field":"settings.enabled","rule":"required","message":"required field is missing"},{"field":"history[1].enabled","rule":"required","message":"required field is missing"},{"field":"zones[a].enabled","rule":"required","message":"required field is missing"},{"field":"zones[c].enabled","rule":"required","message":"required field is missing"},{"field":"zones[d].enabled","rule":"required","message":"required field is missing"}]}`,
+				expectedStatusCode: http.StatusBadRequest,
+			},
+			{
+				name:               "defaults are shown in responses",
+				reqBody:            `{"id":"x","settings":{"enabled":true}}`,
+				reqHeader:          "application/x-protobuf; reqMsg=fixtures.Legacy; respMsg=fixtures.Legacy",
+				expectedRespBody:   `{"id":"x","retries":3,"region":"us-east-1","settings":{"enabled":true,"ratio":0.5},"history":[],"plain":0,"zones":{}}`,
+				expectedStatusCode: http.StatusOK,
+			},
+			{
+				name:               "defaults are not sent by default",
+				cfg:                Config{RawFallback: true},
+				reqBody:            `{"id":"x","settings":{"enabled":true}}`,
+				reqHeader:          "application/x-protobuf; reqMsg=fixtures.Legacy",
+				expectedRespBody:   `{"1":"x","4":{"1":1}}`,
+				expectedStatusCode: http.StatusOK,
+			},
+			{
+				name:               "defaults are filled",
+				cfg:                Config{RawFallback: true, FillDefaults: true},
+				reqBody:            `{"id":"x","settings":{"enabled":true}}`,
+				reqHeader:          "application/x-protobuf; reqMsg=fixtures.Legacy",
+				expectedRespBody:   `{"1":"x","2":3,"3":"us-east-1","4":{"1":1,"2":4602678819172646912}}`,
+				expectedStatusCode: http.StatusOK,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", backend.URL, strings.NewReader(tc.reqBody))
+				req.Header.Add("Content-Type", tc.reqHeader)
+				respRecorder := httptest.NewRecorder()
+				tc.cfg.FileDescriptors = fds
+				srv := New(tc.cfg)
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, tc.expectedStatusCode, respRecorder.Code)
+				body, err := ioutil.ReadAll(respRecorder.Body)
+				assert.NoError(t, err)
+				assert.JSONEq(t, tc.expectedRespBody, string(body))
+			})
+		}
+	})
+
+	t.Run("explicit field presence", func(t *testing.T) {
+		backend := newEchoBackend(t)
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"presence.proto", "editions.proto"})
+		require.NoError(t, err)
+
+		tt := []struct {
+			name             string
+			reqBody          string
+			reqHeader        string
+			expectedRespBody string
+		}{
+			{
+				name:             "proto3 optional unset",
+				reqBody:          `{}`,
+				reqHeader:        "application/x-protobuf; reqMsg=fixtures.Presence; respMsg=fixtures.Presence",
+				expectedRespBody: `{"implicit":0}`,
+			},
+			{
+				name:             "proto3 optional set to zero",
+				reqBody:          `{"count":0,"label":"","flag":false}`,
+				reqHeader:        "application/x-protobuf; reqMsg=fixtures.Presence; respMsg=fixtures.Presence",
+				expectedRespBody: `{"count":0,"label":"","implicit":0,"flag":false}`,
+			},
+			{
+				name:             "editions unset",
+				reqBody:          `{}`,
+				reqHeader:        "application/x-protobuf; reqMsg=fixtures.editions.Item; respMsg=fixtures.editions.Item",
+				expectedRespBody: `{"label":"","values":[]}`,
+			},
+			{
+				name:             "editions set to zero",
+				reqBody:          `{"count":0,"label":""}`,
+				reqHeader:        "application/x-protobuf; reqMsg=fixtures.editions.Item; respMsg=fixtures.editions.Item",
+				expectedRespBody: `{"count":0,"label":"","values":[]}`,
+			},
+			{
+				name:             "editions implicit zero is not sent",
+				reqBody:          `{"count":0,"label":""}`,
+				reqHeader:        "application/x-protobuf; reqMsg=fixtures.editions.Item",
+				expectedRespBody: `{"1":0}`,
+			},
+		}
+
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", backend.URL, strings.NewReader(tc.reqBody))
+				req.Header.Add("Content-Type", tc.reqHeader)
+				respRecorder := httptest.NewRecorder()
+				srv := New(Config{FileDescriptors: fds, RawFallback: true})
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, http.StatusOK, respRecorder.Code)
+				body, err := ioutil.ReadAll(respRecorder.Body)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.expectedRespBody, string(body))
+			})
+		}
+	})
+
+	t.Run("query string encodings", func(t *testing.T) {
+		var query url.Values
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			query = r.URL.Query()
+			body, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+			require.NoError(t, err)
+			w.Write(body)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos", "../internal/moreprotos"}, []string{"hello.proto", "moreprotos.proto"})
+		require.NoError(t, err)
+
+		reqMsg := &testprotos.Req{Text: "some text", Number: 123, List: []string{"a", "b"}}
+		reqBytes, err := proto.Marshal(reqMsg)
+		require.NoError(t, err)
+
+		tt := []struct {
+			name     string
+			encoding string
+			decode   func(string) ([]byte, error)
+		}{
+			{"default", "", base64.URLEncoding.DecodeString},
+			{"url", "url", base64.URLEncoding.DecodeString},
+			{"rawurl", "rawurl", base64.RawURLEncoding.DecodeString},
+			{"std", "std", base64.StdEncoding.DecodeString},
+			{"rawstd", "rawstd", base64.RawStdEncoding.DecodeString},
+			{"hex", "hex", hex.DecodeString},
+		}
+		for _, tc := range tt {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", backend.URL+"?existing=param", strings.NewReader(`{"text":"some text","number":123,"list":["a","b"]}`))
+				header := `application/x-protobuf; reqMsg=testprotos.Req; respMsg=testprotos.Resp; qs=proto_body`
+				if tc.encoding != "" {
+					header += "; qsEncoding=" + tc.encoding
+				}
+				req.Header.Add("Content-Type", header)
+				respRecorder := httptest.NewRecorder()
+				srv := New(Config{FileDescriptors: fds})
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, http.StatusOK, respRecorder.Code)
+				assert.Equal(t, "param", query.Get("existing"))
+				body, err := tc.decode(query.Get("proto_body"))
+				require.NoError(t, err)
+				assert.Equal(t, reqBytes, body)
+			})
+		}
+
+		t.Run("flat", func(t *testing.T) {
+			req := httptest.NewRequest("GET", backend.URL+"?existing=param", strings.NewReader(`{"subReq":{"text":"some text","list":["a","b"]},"num":22}`))
+			req.Header.Add("Content-Type", `application/x-protobuf; reqMsg=moreprotos.Req; respMsg=testprotos.Resp; qsEncoding=flat`)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusOK, respRecorder.Code)
+			assert.Equal(t, url.Values{
+				"existing":    {"param"},
+				"subReq.text": {"some text"},
+				"subReq.list": {"a", "b"},
+				"num":         {"22"},
+			}, query)
+		})
+
+		t.Run("unknown encoding", func(t *testing.T) {
+			req := httptest.NewRequest("GET", backend.URL, strings.NewReader(`{"text":"some text"}`))
+			req.Header.Add("Content-Type", `application/x-protobuf; reqMsg=testprotos.Req; respMsg=testprotos.Resp; qs=proto_body; qsEncoding=base32`)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		})
+	})
+
+	t.Run("messages in headers", func(t *testing.T) {
+		var received *http.Request
+		var receivedBody []byte
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r
+			var err error
+			receivedBody, err = ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			body, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+			require.NoError(t, err)
+			w.Write(body)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		decodeHeader := func(t *testing.T, name string, msg proto.Message) {
+			b, err := base64.StdEncoding.DecodeString(received.Header.Get(name))
+			require.NoError(t, err)
+			require.NoError(t, proto.Unmarshal(b, msg))
+		}
+
+		t.Run("header messages alongside the body", func(t *testing.T) {
+			req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"some text"}`))
+			req.Header.Add("Content-Type", `application/x-protobuf; reqMsg=testprotos.Req; respMsg=testprotos.Resp; hdr="X-Number-Bin=testprotos.Resp2, X-Text-Bin=testprotos.Resp"`)
+			req.Header.Add("X-Number-Bin", `{"number":5}`)
+			req.Header.Add("X-Text-Bin", `{"text":"in a header"}`)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusOK, respRecorder.Code)
+			var number testprotos.Resp2
+			decodeHeader(t, "X-Number-Bin", &number)
+			assert.Equal(t, int32(5), number.Number)
+			var text testprotos.Resp
+			decodeHeader(t, "X-Text-Bin", &text)
+			assert.Equal(t, "in a header", text.Text)
+			var body testprotos.Req
+			require.NoError(t, proto.Unmarshal(receivedBody, &body))
+			assert.Equal(t, "some text", body.Text)
+		})
+
+		t.Run("body message in a header", func(t *testing.T) {
+			req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"some text"}`))
+			req.Header.Add("Content-Type", `application/x-protobuf; reqMsg=testprotos.Req; respMsg=testprotos.Resp; hdr=X-Request-Context-Bin`)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusOK, respRecorder.Code)
+			var ctx testprotos.Req
+			decodeHeader(t, "X-Request-Context-Bin", &ctx)
+			assert.Equal(t, "some text", ctx.Text)
+			assert.Empty(t, receivedBody)
+		})
+
+		t.Run("unknown header message type", func(t *testing.T) {
+			req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"some text"}`))
+			req.Header.Add("Content-Type", `application/x-protobuf; reqMsg=testprotos.Req; respMsg=testprotos.Resp; hdr="X-Number-Bin=testprotos.DoesntExist"`)
+			req.Header.Add("X-Number-Bin", `{"number":5}`)
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		})
+	})
+
+	t.Run("protobuf response headers and trailers", func(t *testing.T) {
+		encode := func(msg proto.Message) string {
+			b, err := proto.Marshal(msg)
+			require.NoError(t, err)
+			return base64.RawStdEncoding.EncodeToString(b)
+		}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Trailer", "X-Trailer-Bin")
+			w.Header().Set("X-Details-Bin", encode(&testprotos.Resp2{Number: 7}))
+			w.Header().Set("X-Undecodable-Bin", "not base64!")
+			body, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+			require.NoError(t, err)
+			w.Write(body)
+			w.Header().Set("X-Trailer-Bin", encode(&testprotos.Resp{Text: "trailer"}))
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+		respHeaders := map[string]string{
+			"x-details-bin":     "testprotos.Resp2",
+			"X-Trailer-Bin":     "testprotos.Resp",
+			"X-Undecodable-Bin": "testprotos.Resp",
+		}
+
+		t.Run("rewrite", func(t *testing.T) {
+			req := httptest.NewRequest("GET", backend.URL, nil)
+			req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds, ResponseHeaders: respHeaders})
+			srv.proxyRequest(respRecorder, req)
+
+			resp := respRecorder.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, `{"number":7}`, resp.Header.Get("X-Details-Bin"))
+			assert.Equal(t, "not base64!", resp.Header.Get("X-Undecodable-Bin"))
+			assert.Equal(t, `{"text":"trailer"}`, resp.Trailer.Get("X-Trailer-Bin"))
+		})
+
+		t.Run("decoded copies", func(t *testing.T) {
+			req := httptest.NewRequest("GET", backend.URL, nil)
+			req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds, ResponseHeaders: respHeaders, DecodedHeaderCopies: true})
+			srv.proxyRequest(respRecorder, req)
+
+			resp := respRecorder.Result()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+			assert.Equal(t, encode(&testprotos.Resp2{Number: 7}), resp.Header.Get("X-Details-Bin"))
+			assert.Equal(t, `{"number":7}`, resp.Header.Get("X-Protoxy-Decoded-X-Details-Bin"))
+			assert.Equal(t, `{"text":"trailer"}`, resp.Trailer.Get("X-Protoxy-Decoded-X-Trailer-Bin"))
+		})
+	})
+
+	t.Run("multipart parts", func(t *testing.T) {
+		file := []byte{0x00, 0xff, 0x10, 0x20}
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertHeaderParamsHaveBeenStripped(t, r)
+			require.NoError(t, r.ParseMultipartForm(1<<20))
+
+			metadata := r.MultipartForm.File["metadata"][0]
+			assert.Equal(t, "application/x-protobuf", metadata.Header.Get("Content-Type"))
+			f, err := metadata.Open()
+			require.NoError(t, err)
+			b, err := ioutil.ReadAll(f)
+			require.NoError(t, err)
+			var req testprotos.Req
+			require.NoError(t, proto.Unmarshal(b, &req))
+			assert.Equal(t, "some text", req.Text)
+
+			blob := r.MultipartForm.File["blob"][0]
+			f, err = blob.Open()
+			require.NoError(t, err)
+			b, err = ioutil.ReadAll(f)
+			require.NoError(t, err)
+			assert.Equal(t, file, b)
+			assert.Equal(t, "a note", r.MultipartForm.Value["note"][0])
+
+			resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+			require.NoError(t, err)
+			w.Write(resp)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		body := bytes.NewBuffer(nil)
+		mw := multipart.NewWriter(body)
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="metadata"; filename="metadata.json"`},
+			"Content-Type":        {"application/json; reqMsg=testprotos.Req"},
+		})
+		require.NoError(t, err)
+		part.Write([]byte(`{"text":"some text"}`))
+		part, err = mw.CreateFormFile("blob", "blob.bin")
+		require.NoError(t, err)
+		part.Write(file)
+		require.NoError(t, mw.WriteField("note", "a note"))
+		require.NoError(t, mw.Close())
+
+		req := httptest.NewRequest("POST", backend.URL, body)
+		req.Header.Add("Content-Type", mw.FormDataContentType()+"; respMsg=testprotos.Resp")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusOK, respRecorder.Code)
+		assert.Equal(t, `{"text":"This is a response"}`, respRecorder.Body.String())
+	})
+
+	t.Run("compressed bodies", func(t *testing.T) {
+		// The backend decompresses the request and compresses the response with the same Content-Encoding
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assertHeaderParamsHaveBeenStripped(t, r)
+			encoding := r.Header.Get("Content-Encoding")
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			body, err = decompress(encoding, body, 0)
+			require.NoError(t, err)
+			var req testprotos.Req
+			require.NoError(t, proto.Unmarshal(body, &req))
+
+			resp, err := proto.Marshal(&testprotos.Resp{Text: req.Text})
+			require.NoError(t, err)
+			for _, coding := range parseContentEncoding(encoding) {
+				resp, err = compress(coding, resp)
+				require.NoError(t, err)
+			}
+			w.Header().Set("Content-Encoding", encoding)
+			w.Write(resp)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		for _, encoding := range []string{"gzip", "deflate", "br", "zstd"} {
+			t.Run(encoding, func(t *testing.T) {
+				req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"compressed"}`))
+				req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp; compress="+encoding)
+				respRecorder := httptest.NewRecorder()
+				srv := New(Config{FileDescriptors: fds})
+				srv.proxyRequest(respRecorder, req)
+
+				resp := respRecorder.Result()
+				assert.Equal(t, http.StatusOK, resp.StatusCode)
+				assert.Empty(t, resp.Header.Get("Content-Encoding"))
+				assert.Equal(t, `{"text":"compressed"}`, respRecorder.Body.String())
+			})
+		}
+
+		t.Run("multiple codings", func(t *testing.T) {
+			respBytes, err := proto.Marshal(&testprotos.Resp{Text: "layered"})
+			require.NoError(t, err)
+			respBytes, err = compress("gzip", respBytes)
+			require.NoError(t, err)
+			respBytes, err = compress("br", respBytes)
+			require.NoError(t, err)
+			layered := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip, br")
+				w.Write(respBytes)
+			}))
+			defer layered.Close()
+
+			req := httptest.NewRequest("GET", layered.URL, nil)
+			req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusOK, respRecorder.Code)
+			assert.Equal(t, `{"text":"layered"}`, respRecorder.Body.String())
+		})
+
+		t.Run("unsupported request compression", func(t *testing.T) {
+			req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"compressed"}`))
+			req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp; compress=lz4")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		})
+
+		t.Run("unsupported response encoding", func(t *testing.T) {
+			unsupported := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "lz4")
+				w.Write([]byte{0x04, 0x22, 0x4d, 0x18})
+			}))
+			defer unsupported.Close()
+
+			req := httptest.NewRequest("GET", unsupported.URL, nil)
+			req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds})
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		})
+	})
+
+	t.Run("body size limits", func(t *testing.T) {
+		largeText := strings.Repeat("a", 100)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			text := "small"
+			if r.Header.Get("Content-Type") == "application/json" {
+				// Passed through unconverted
+				assert.JSONEq(t, `{"text":"`+largeText+`"}`, string(body))
+				text = largeText
+			} else {
+				var req testprotos.Req
+				require.NoError(t, proto.Unmarshal(body, &req))
+				text = req.Text
+			}
+			resp, err := proto.Marshal(&testprotos.Resp{Text: text})
+			require.NoError(t, err)
+			w.Write(resp)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		tests := []struct {
+			name         string
+			text         string
+			cfg          Config
+			expectedCode int
+			expectedBody string
+		}{
+			{
+				name:         "within limits",
+				text:         "small",
+				cfg:          Config{MaxRequestBytes: 64, MaxResponseBytes: 64},
+				expectedCode: http.StatusOK,
+				expectedBody: `{"text":"small"}`,
+			},
+			{
+				name:         "request too large",
+				text:         largeText,
+				cfg:          Config{MaxRequestBytes: 64},
+				expectedCode: http.StatusRequestEntityTooLarge,
+				expectedBody: "The request body exceeds the 64 byte limit of Protoxy.",
+			},
+			{
+				name:         "response too large",
+				text:         largeText,
+				cfg:          Config{MaxResponseBytes: 64},
+				expectedCode: http.StatusBadGateway,
+				expectedBody: "The response body exceeds the 64 byte limit of Protoxy.",
+			},
+			{
+				name:         "large bodies passed through",
+				text:         largeText,
+				cfg:          Config{MaxRequestBytes: 64, MaxResponseBytes: 64, PassLargeBodies: true},
+				expectedCode: http.StatusOK,
+				expectedBody: "\n\x64" + largeText,
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"`+tc.text+`"}`))
+				req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+				respRecorder := httptest.NewRecorder()
+				tc.cfg.FileDescriptors = fds
+				srv := New(tc.cfg)
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, tc.expectedCode, respRecorder.Code)
+				assert.Equal(t, tc.expectedBody, respRecorder.Body.String())
+			})
+		}
+	})
+	t.Run("gzip bomb", func(t *testing.T) {
+		// 10MB of zeros compresses to about 10KB
+		bomb, err := compress(encodingGzip, make([]byte, 10<<20))
+		require.NoError(t, err)
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", encodingGzip)
+			w.Write(bomb)
+		}))
+		defer backend.Close()
+
+		fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+		require.NoError(t, err)
+
+		tests := []struct {
+			name         string
+			cfg          Config
+			expectedCode int
+			expectedBody string
+		}{
+			{
+				name:         "rejected",
+				cfg:          Config{MaxResponseBytes: 1 << 20},
+				expectedCode: http.StatusBadGateway,
+				expectedBody: "The response body exceeds the 1048576 byte limit of Protoxy.",
+			},
+			{
+				name:         "passed through compressed",
+				cfg:          Config{MaxResponseBytes: 1 << 20, PassLargeBodies: true},
+				expectedCode: http.StatusOK,
+				expectedBody: string(bomb),
+			},
+		}
+
+		for _, tc := range tests {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"hi"}`))
+				req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+				// Otherwise the transport decompresses the response before protoxy sees it
+				req.Header.Add("Accept-Encoding", encodingGzip)
+				respRecorder := httptest.NewRecorder()
+				tc.cfg.FileDescriptors = fds
+				srv := New(tc.cfg)
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, tc.expectedCode, respRecorder.Code)
+				assert.Equal(t, tc.expectedBody, respRecorder.Body.String())
+				if tc.cfg.PassLargeBodies {
+					assert.Equal(t, encodingGzip, respRecorder.Header().Get("Content-Encoding"))
+				}
+			})
+		}
+	})
+}
+
+func TestServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	srv := New(Config{Port: uint16(port)})
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		resp, err := http.Get("http://127.0.0.1:" + strconv.Itoa(port) + "/metrics")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-errs:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after its context was done")
+	}
 }
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// Query string encodings that can be selected with the qsEncoding Content-Type param.
+const (
+	qsEncodingURL    = "url"
+	qsEncodingRawURL = "rawurl"
+	qsEncodingStd    = "std"
+	qsEncodingRawStd = "rawstd"
+	qsEncodingHex    = "hex"
+	qsEncodingFlat   = "flat"
+)
+
+// encodeQueryString merges the request message into the query string of u. The flat encoding adds one param per
+// field, following gRPC-gateway conventions. All other encodings add the encoded message bytes as the qsParam param.
+func encodeQueryString(u *url.URL, msg *dynamic.Message, msgBytes []byte, qsParam string, encoding string) error {
+	query := u.Query()
+	if encoding == qsEncodingFlat {
+		if msg == nil {
+			return fmt.Errorf("the %v query string encoding requires a request message type", encoding)
+		}
+		if err := flattenMessage(query, "", msg); err != nil {
+			return err
+		}
+		u.RawQuery = query.Encode()
+		return nil
+	}
+
+	encoded, err := EncodeBytes(msgBytes, encoding)
+	if err != nil {
+		return err
+	}
+	query.Set(qsParam, encoded)
+	u.RawQuery = query.Encode()
+	return nil
+}
+
+// EncodeBytes encodes b as text with one of the query string encodings other than flat. An empty encoding is url.
+func EncodeBytes(b []byte, encoding string) (string, error) {
+	switch encoding {
+	case "", qsEncodingURL:
+		return base64.URLEncoding.EncodeToString(b), nil
+	case qsEncodingRawURL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case qsEncodingStd:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case qsEncodingRawStd:
+		return base64.RawStdEncoding.EncodeToString(b), nil
+	case qsEncodingHex:
+		return hex.EncodeToString(b), nil
+	}
+	return "", fmt.Errorf("unknown query string encoding '%v'", encoding)
+}
+
+// DecodeBytes is the inverse of EncodeBytes.
+func DecodeBytes(s string, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", qsEncodingURL:
+		return base64.URLEncoding.DecodeString(s)
+	case qsEncodingRawURL:
+		return base64.RawURLEncoding.DecodeString(s)
+	case qsEncodingStd:
+		return base64.StdEncoding.DecodeString(s)
+	case qsEncodingRawStd:
+		return base64.RawStdEncoding.DecodeString(s)
+	case qsEncodingHex:
+		return hex.DecodeString(s)
+	}
+	return nil, fmt.Errorf("unknown query string encoding '%v'", encoding)
+}
+
+// flattenMessage adds a param for every set field in msg, using dotted paths for nested messages, one param per
+// element for repeated fields and name[key] for map entries.
+func flattenMessage(query url.Values, prefix string, msg *dynamic.Message) error {
+	for _, fd := range msg.GetMessageDescriptor().GetFields() {
+		if !msg.HasField(fd) {
+			continue
+		}
+		name := prefix + fd.GetName()
+		val := msg.GetField(fd)
+
+		switch {
+		case fd.IsMap():
+			for k, v := range val.(map[interface{}]interface{}) {
+				if err := flattenValue(query, fmt.Sprintf("%s[%v]", name, k), fd.GetMapValueType(), v); err != nil {
+					return err
+				}
+			}
+		case fd.IsRepeated():
+			for _, v := range val.([]interface{}) {
+				if err := flattenValue(query, name, fd, v); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := flattenValue(query, name, fd, val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func flattenValue(query url.Values, name string, fd *desc.FieldDescriptor, val interface{}) error {
+	switch val := val.(type) {
+	case *dynamic.Message:
+		if !strings.HasPrefix(val.GetMessageDescriptor().GetFullyQualifiedName(), "google.protobuf.") {
+			return flattenMessage(query, name+".", val)
+		}
+		// Well-known types such as Timestamp and Duration are sent in their JSON string form
+		js, err := (&jsonpb.Marshaler{}).MarshalToString(val)
+		if err != nil {
+			return err
+		}
+		if s, err := strconv.Unquote(js); err == nil {
+			js = s
+		}
+		query.Add(name, js)
+	case []byte:
+		query.Add(name, base64.StdEncoding.EncodeToString(val))
+	case float32:
+		query.Add(name, strconv.FormatFloat(float64(val), 'g', -1, 32))
+	case float64:
+		query.Add(name, strconv.FormatFloat(val, 'g', -1, 64))
+	case int32:
+		if enum := fd.GetEnumType(); enum != nil {
+			if ev := enum.FindValueByNumber(val); ev != nil {
+				query.Add(name, ev.GetName())
+				return nil
+			}
+		}
+		query.Add(name, strconv.Itoa(int(val)))
+	default:
+		query.Add(name, fmt.Sprint(val))
+	}
+	return nil
+}
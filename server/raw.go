@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// rawField holds every value seen on the wire for a single field number.
+type rawField struct {
+	number protowire.Number
+	values []interface{}
+}
+
+// rawMessage is a schema-less view of a protobuf message, similar to the output of `protoc --decode_raw`.
+// Fields are kept in the order they first appear on the wire.
+type rawMessage struct {
+	fields []*rawField
+}
+
+func (m *rawMessage) add(num protowire.Number, v interface{}) {
+	for _, f := range m.fields {
+		if f.number == num {
+			f.values = append(f.values, v)
+			return
+		}
+	}
+	m.fields = append(m.fields, &rawField{number: num, values: []interface{}{v}})
+}
+
+// MarshalJSON renders the message as a JSON object keyed by field number.
+// Fields that occur more than once are rendered as arrays.
+func (m *rawMessage) MarshalJSON() ([]byte, error) {
+	buf := bytes.NewBufferString("{")
+	for i, f := range m.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(`"` + strconv.Itoa(int(f.number)) + `":`)
+		var v interface{} = f.values
+		if len(f.values) == 1 {
+			v = f.values[0]
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// decodeRaw decodes the protobuf wire format without a message descriptor.
+// Length-delimited fields are shown as strings when they look like text, as nested messages when they parse as one,
+// and as base64 otherwise.
+func decodeRaw(b []byte) (*rawMessage, error) {
+	msg := &rawMessage{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			v, n = protowire.ConsumeFixed32(b)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			var field []byte
+			field, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				v = decodeRawBytes(field)
+			}
+		case protowire.StartGroupType:
+			var group []byte
+			group, n = protowire.ConsumeGroup(num, b)
+			if n >= 0 {
+				v, err := decodeRaw(group)
+				if err != nil {
+					return nil, err
+				}
+				msg.add(num, v)
+				b = b[n:]
+				continue
+			}
+		default:
+			return nil, fmt.Errorf("unexpected wire type %v for field %v", typ, num)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		msg.add(num, v)
+		b = b[n:]
+	}
+	return msg, nil
+}
+
+func decodeRawBytes(b []byte) interface{} {
+	if isPrintable(b) {
+		return string(b)
+	}
+	if nested, err := decodeRaw(b); err == nil {
+		return nested
+	}
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeRawJSON encodes a JSON object keyed by field number into the protobuf wire format.
+// Integers are encoded as varints, other numbers as doubles, strings as length-delimited bytes and objects as
+// nested messages. Arrays produce one occurrence of the field per element.
+func encodeRawJSON(r io.Reader) ([]byte, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var obj map[string]interface{}
+	if err := dec.Decode(&obj); err != nil {
+		return nil, err
+	}
+	return appendRawMessage(nil, obj)
+}
+
+func appendRawMessage(b []byte, obj map[string]interface{}) ([]byte, error) {
+	nums := make([]protowire.Number, 0, len(obj))
+	values := make(map[protowire.Number]interface{}, len(obj))
+	for k, v := range obj {
+		n, err := strconv.ParseInt(k, 10, 32)
+		if err != nil || !protowire.Number(n).IsValid() {
+			return nil, fmt.Errorf("invalid field number %q", k)
+		}
+		nums = append(nums, protowire.Number(n))
+		values[protowire.Number(n)] = v
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	var err error
+	for _, num := range nums {
+		if list, ok := values[num].([]interface{}); ok {
+			for _, v := range list {
+				if b, err = appendRawValue(b, num, v); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if b, err = appendRawValue(b, num, values[num]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func appendRawValue(b []byte, num protowire.Number, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return b, nil
+	case bool:
+		b = protowire.AppendTag(b, num, protowire.VarintType)
+		return protowire.AppendVarint(b, protowire.EncodeBool(v)), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			return protowire.AppendVarint(b, uint64(i)), nil
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			b = protowire.AppendTag(b, num, protowire.VarintType)
+			return protowire.AppendVarint(b, u), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, num, protowire.Fixed64Type)
+		return protowire.AppendFixed64(b, math.Float64bits(f)), nil
+	case string:
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendString(b, v), nil
+	case map[string]interface{}:
+		nested, err := appendRawMessage(nil, v)
+		if err != nil {
+			return nil, err
+		}
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		return protowire.AppendBytes(b, nested), nil
+	case []interface{}:
+		return nil, errors.New("nested arrays are not supported")
+	default:
+		return nil, fmt.Errorf("unsupported value %v for field %v", v, num)
+	}
+}
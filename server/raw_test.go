@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/moreprotos"
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRawRoundTrip(t *testing.T) {
+	tt := []struct {
+		name    string
+		msg     proto.Message
+		rawJSON string
+	}{
+		{
+			name:    "scalars and repeated",
+			msg:     &testprotos.Req{Text: "some text", Number: -5, List: []string{"a", "b"}},
+			rawJSON: `{"1":"some text","2":18446744073709551611,"3":["a","b"]}`,
+		},
+		{
+			name:    "nested message",
+			msg:     &moreprotos.Req{SubReq: &testprotos.Req{Text: "hi"}, Num: 22},
+			rawJSON: `{"1":{"1":"hi"},"2":22}`,
+		},
+		{
+			name:    "empty",
+			msg:     &testprotos.Resp{},
+			rawJSON: `{}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			wire, err := proto.Marshal(tc.msg)
+			require.NoError(t, err)
+
+			decoded, err := decodeRaw(wire)
+			require.NoError(t, err)
+			b, err := json.Marshal(decoded)
+			require.NoError(t, err)
+			assert.Equal(t, tc.rawJSON, string(b))
+
+			encoded, err := encodeRawJSON(strings.NewReader(tc.rawJSON))
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(wire, encoded))
+		})
+	}
+
+	t.Run("invalid field number", func(t *testing.T) {
+		_, err := encodeRawJSON(strings.NewReader(`{"text":"hi"}`))
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/camgraff/protoxy/log"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// redactedValue replaces the values of sensitive fields in JSON shown to people.
+var redactedValue = json.RawMessage(`"[REDACTED]"`)
+
+// redactor decides which fields are masked when messages are rendered for people, such as in payload dumps. The
+// payloads sent to clients and upstreams are never redacted. A field is redacted if it is marked with debug_redact,
+// sets one of the custom bool options to true, or is listed by its fully-qualified name.
+type redactor struct {
+	options     *optionsParser
+	fields      map[string]bool
+	anyResolver jsonpb.AnyResolver
+
+	mu    sync.Mutex
+	cache map[*desc.FieldDescriptor]bool
+}
+
+// newRedactor returns a redactor for the custom options and fields, given by fully-qualified name such as
+// acme.sensitive or example.Login.password. The messages packed in Any fields are found with resolver.
+func newRedactor(files []*desc.FileDescriptor, resolver jsonpb.AnyResolver, options []string, fields []string) *redactor {
+	names := map[string]bool{}
+	for _, o := range options {
+		names[strings.Trim(o, "()")] = true
+	}
+	parser, err := newOptionsParser(files, "google.protobuf.FieldOptions", names)
+	if err != nil {
+		log.Log.WithError(err).Error("unable to load redaction options, only debug_redact and listed fields will be masked")
+		parser = &optionsParser{}
+	}
+	found := map[string]bool{}
+	for _, ext := range parser.extensions {
+		found[ext.GetFullyQualifiedName()] = true
+	}
+	for name := range names {
+		if !found[name] {
+			log.Log.WithField("option", name).Warn("redaction option is not declared in the loaded files")
+		}
+	}
+
+	r := &redactor{
+		options:     parser,
+		fields:      map[string]bool{},
+		anyResolver: resolver,
+		cache:       map[*desc.FieldDescriptor]bool{},
+	}
+	for _, f := range fields {
+		if !fieldExists(files, f) {
+			log.Log.WithField("field", f).Warn("redacted field is not declared in the loaded files")
+		}
+		r.fields[f] = true
+	}
+	return r
+}
+
+func fieldExists(files []*desc.FileDescriptor, name string) bool {
+	for _, fd := range files {
+		if _, ok := fd.FindSymbol(name).(*desc.FieldDescriptor); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isRedacted reports whether the value of fd must not be shown.
+func (r *redactor) isRedacted(fd *desc.FieldDescriptor) bool {
+	if fd.GetFieldOptions().GetDebugRedact() || r.fields[fd.GetFullyQualifiedName()] {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if redacted, ok := r.cache[fd]; ok {
+		return redacted
+	}
+	redacted := false
+	opts, err := r.options.parse(fd)
+	if err != nil {
+		log.Log.WithError(err).WithField("field", fd.GetFullyQualifiedName()).Warn("unable to read redaction options")
+	}
+	if opts != nil {
+		for _, ext := range r.options.extensions {
+			if set, _ := opts.GetField(ext).(bool); set && opts.HasField(ext) {
+				redacted = true
+				break
+			}
+		}
+	}
+	r.cache[fd] = redacted
+	return redacted
+}
+
+// RedactJSON masks the values of redacted fields in js, the JSON of a message of one of msgTypes, so that it can be
+// shown to people. The first type that js is valid for is used, and js is returned unchanged if there is none.
+func (s *Server) RedactJSON(js []byte, msgTypes []string) ([]byte, error) {
+	unmarshaler := jsonpb.Unmarshaler{AnyResolver: s.anyResolver}
+	for _, name := range msgTypes {
+		for _, fd := range s.FileDescriptors {
+			md := fd.FindMessage(name)
+			if md == nil {
+				continue
+			}
+			msg := dynamic.NewMessage(md)
+			if err := msg.UnmarshalJSONPB(&unmarshaler, js); err != nil {
+				break
+			}
+			return s.redactor.redactJSON(js, msg)
+		}
+	}
+	return js, nil
+}
+
+// redactJSON masks the values of redacted fields in js, the JSON encoding of msg.
+func (r *redactor) redactJSON(js []byte, msg *dynamic.Message) ([]byte, error) {
+	md := msg.GetMessageDescriptor()
+	if md.GetFullyQualifiedName() == "google.protobuf.Any" {
+		return r.redactAnyJSON(js, msg)
+	}
+	if strings.HasPrefix(md.GetFullyQualifiedName(), "google.protobuf.") {
+		return js, nil
+	}
+	keys, values, err := decodeJSONObject(js)
+	if err != nil || keys == nil {
+		return js, err
+	}
+
+	for _, fd := range md.GetFields() {
+		key := fd.GetJSONName()
+		val, ok := values[key]
+		if !ok {
+			continue
+		}
+		if r.isRedacted(fd) {
+			values[key] = redactedValue
+			continue
+		}
+		if fd.GetMessageType() == nil || !msg.HasField(fd) {
+			continue
+		}
+		nested := msg.GetField(fd)
+		if fd.GetMessageType().GetFullyQualifiedName() == "google.protobuf.Any" {
+			// Any fields hold generated messages, which are converted so that redactAnyJSON can read them
+			nested = asDynamicValue(nested)
+		}
+		if values[key], err = transformNestedJSON(val, nested, r.redactJSON); err != nil {
+			return nil, err
+		}
+	}
+	return encodeJSONObject(keys, values), nil
+}
+
+// redactAnyJSON masks the redacted fields of the message packed in msg, an Any whose JSON is js. The fields of the packed
+// message are next to @type, except for well-known types, whose JSON is the value key.
+func (r *redactor) redactAnyJSON(js []byte, msg *dynamic.Message) ([]byte, error) {
+	typeURL, _ := msg.GetFieldByName("type_url").(string)
+	value, _ := msg.GetFieldByName("value").([]byte)
+	if r.anyResolver == nil || typeURL == "" {
+		return js, nil
+	}
+	resolved, err := r.anyResolver.Resolve(typeURL)
+	if err != nil {
+		return js, nil
+	}
+	packed, err := dynamic.AsDynamicMessage(resolved)
+	if err != nil {
+		return js, nil
+	}
+	if err := packed.Unmarshal(value); err != nil {
+		return js, nil
+	}
+	if !strings.HasPrefix(packed.GetMessageDescriptor().GetFullyQualifiedName(), "google.protobuf.") {
+		return r.redactJSON(js, packed)
+	}
+
+	keys, values, err := decodeJSONObject(js)
+	if err != nil || keys == nil {
+		return js, err
+	}
+	val, ok := values["value"]
+	if !ok {
+		return js, nil
+	}
+	if values["value"], err = r.redactJSON(val, packed); err != nil {
+		return nil, err
+	}
+	return encodeJSONObject(keys, values), nil
+}
+
+// asDynamicValue converts the messages of a field value, which may be a list or map of them, to dynamic messages.
+// Values that can't be converted are left as they are.
+func asDynamicValue(val interface{}) interface{} {
+	switch val := val.(type) {
+	case proto.Message:
+		if msg, err := dynamic.AsDynamicMessage(val); err == nil {
+			return msg
+		}
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for i, e := range val {
+			list[i] = asDynamicValue(e)
+		}
+		return list
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(val))
+		for k, e := range val {
+			m[k] = asDynamicValue(e)
+		}
+		return m
+	}
+	return val
+}
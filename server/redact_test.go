@@ -0,0 +1,102 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedact(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"sensitive.proto"})
+	require.NoError(t, err)
+	md := fds[0].FindMessage("fixtures.Credentials")
+	require.NotNil(t, md)
+
+	js := `{"username":"ada","password":"hunter2","token":{"value":"abc","expires":"10"},"history":[{"value":"def","expires":"5"}],"apiKey":"key","email":"ada@example.com","sessions":{"web":{"value":"ghi","expires":"1"}},` +
+		`"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"jkl","expires":"2"},{"@type":"type.googleapis.com/google.protobuf.Any","value":{"@type":"type.googleapis.com/fixtures.Token","value":"mno","expires":"3"}}]}`
+	resolver := dynamic.AnyResolver(nil, fds...)
+	msg := dynamic.NewMessage(md)
+	require.NoError(t, msg.UnmarshalJSONPB(&jsonpb.Unmarshaler{AnyResolver: resolver}, []byte(js)))
+
+	tests := []struct {
+		name     string
+		options  []string
+		fields   []string
+		expected string
+	}{
+		{
+			name:     "debug_redact",
+			expected: `{"username":"ada","password":"[REDACTED]","token":{"value":"[REDACTED]","expires":"10"},"history":[{"value":"[REDACTED]","expires":"5"}],"apiKey":"key","email":"ada@example.com","sessions":{"web":{"value":"[REDACTED]","expires":"1"}},"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"2"},{"@type":"type.googleapis.com/google.protobuf.Any","value":{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"3"}}]}`,
+		},
+		{
+			name:     "custom option",
+			options:  []string{"(fixtures.sensitive)"},
+			expected: `{"username":"ada","password":"[REDACTED]","token":{"value":"[REDACTED]","expires":"10"},"history":[{"value":"[REDACTED]","expires":"5"}],"apiKey":"[REDACTED]","email":"ada@example.com","sessions":{"web":{"value":"[REDACTED]","expires":"1"}},"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"2"},{"@type":"type.googleapis.com/google.protobuf.Any","value":{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"3"}}]}`,
+		},
+		{
+			name:     "explicit fields",
+			fields:   []string{"fixtures.Credentials.email", "fixtures.Token.expires"},
+			expected: `{"username":"ada","password":"[REDACTED]","token":{"value":"[REDACTED]","expires":"[REDACTED]"},"history":[{"value":"[REDACTED]","expires":"[REDACTED]"}],"apiKey":"key","email":"[REDACTED]","sessions":{"web":{"value":"[REDACTED]","expires":"[REDACTED]"}},"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"[REDACTED]"},{"@type":"type.googleapis.com/google.protobuf.Any","value":{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"[REDACTED]"}}]}`,
+		},
+		{
+			name:     "whole message field",
+			fields:   []string{"fixtures.Credentials.token"},
+			expected: `{"username":"ada","password":"[REDACTED]","token":"[REDACTED]","history":[{"value":"[REDACTED]","expires":"5"}],"apiKey":"key","email":"ada@example.com","sessions":{"web":{"value":"[REDACTED]","expires":"1"}},"extras":[{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"2"},{"@type":"type.googleapis.com/google.protobuf.Any","value":{"@type":"type.googleapis.com/fixtures.Token","value":"[REDACTED]","expires":"3"}}]}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRedactor(fds, resolver, tc.options, tc.fields)
+			b, err := msg.MarshalJSONPB(&jsonpb.Marshaler{AnyResolver: resolver})
+			require.NoError(t, err)
+			b, err = r.redactJSON(b, msg)
+			require.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(b))
+		})
+	}
+}
+
+func TestServerRedactJSON(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"sensitive.proto"})
+	require.NoError(t, err)
+	s := New(Config{FileDescriptors: fds})
+
+	tests := []struct {
+		name     string
+		js       string
+		msgTypes []string
+		expected string
+	}{
+		{
+			name:     "first matching type",
+			js:       `{"username":"ada","password":"hunter2"}`,
+			msgTypes: []string{"fixtures.Token", "fixtures.Credentials"},
+			expected: `{"username":"ada","password":"[REDACTED]"}`,
+		},
+		{
+			name:     "unknown type",
+			js:       `{"username":"ada","password":"hunter2"}`,
+			msgTypes: []string{"fixtures.Missing"},
+			expected: `{"username":"ada","password":"hunter2"}`,
+		},
+		{
+			name:     "not a message",
+			js:       `Protoxy was unable to successfully proxy the request.`,
+			msgTypes: []string{"fixtures.Credentials"},
+			expected: `Protoxy was unable to successfully proxy the request.`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := s.RedactJSON([]byte(tc.js), tc.msgTypes)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, string(b))
+		})
+	}
+}
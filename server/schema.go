@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/camgraff/protoxy/log"
+
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// Schema lists the types declared in the loaded files, including nested types.
+type Schema struct {
+	Messages []string  `json:"messages"`
+	Enums    []string  `json:"enums"`
+	Services []Service `json:"services"`
+}
+
+// Service is a service and its methods.
+type Service struct {
+	Name    string   `json:"name"`
+	Methods []Method `json:"methods"`
+}
+
+// Method is a method of a service, with the fully-qualified names of its input and output messages.
+type Method struct {
+	Name            string        `json:"name"`
+	Input           string        `json:"input"`
+	Output          string        `json:"output"`
+	ClientStreaming bool          `json:"clientStreaming,omitempty"`
+	ServerStreaming bool          `json:"serverStreaming,omitempty"`
+	Comment         string        `json:"comment,omitempty"`
+	HTTP            []HTTPBinding `json:"http,omitempty"`
+}
+
+// httpRuleOption is the method option that maps a method to HTTP, as used by gRPC-gateway.
+const httpRuleOption = "google.api.http"
+
+// HTTPBinding is a mapping of a method to HTTP from its google.api.http option. Path is a template such as
+// /v1/{name=shelves/*}. Body names the request field sent as the body, or * for the whole request, and is empty if
+// there is no body. ResponseBody names the response field returned as the body, and is empty for the whole response.
+type HTTPBinding struct {
+	Method       string `json:"method"`
+	Path         string `json:"path"`
+	Body         string `json:"body,omitempty"`
+	ResponseBody string `json:"responseBody,omitempty"`
+}
+
+// Description describes a single message, enum or service. Only the fields for its kind are set.
+type Description struct {
+	Kind     string          `json:"kind"`
+	Name     string          `json:"name"`
+	Comment  string          `json:"comment,omitempty"`
+	Fields   []Field         `json:"fields,omitempty"`
+	Values   []EnumValue     `json:"values,omitempty"`
+	Methods  []Method        `json:"methods,omitempty"`
+	Skeleton json.RawMessage `json:"skeleton,omitempty"`
+}
+
+// Field is a field of a message. Type is a scalar type such as int64, a fully-qualified message or enum name, or a
+// map<K, V>, prefixed with repeated, optional or required where that applies.
+type Field struct {
+	Name     string `json:"name"`
+	JSONName string `json:"jsonName"`
+	Number   int32  `json:"number"`
+	Type     string `json:"type"`
+	Oneof    string `json:"oneof,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// EnumValue is a value of an enum.
+type EnumValue struct {
+	Name    string `json:"name"`
+	Number  int32  `json:"number"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// Schema returns the messages, enums and services declared in s.FileDescriptors.
+func (s *Server) Schema() Schema {
+	schema := Schema{Messages: []string{}, Enums: []string{}, Services: []Service{}}
+	var addMessages func(mds []*desc.MessageDescriptor)
+	addEnums := func(eds []*desc.EnumDescriptor) {
+		for _, ed := range eds {
+			schema.Enums = append(schema.Enums, ed.GetFullyQualifiedName())
+		}
+	}
+	addMessages = func(mds []*desc.MessageDescriptor) {
+		for _, md := range mds {
+			if md.IsMapEntry() {
+				continue
+			}
+			schema.Messages = append(schema.Messages, md.GetFullyQualifiedName())
+			addEnums(md.GetNestedEnumTypes())
+			addMessages(md.GetNestedMessageTypes())
+		}
+	}
+
+	for _, fd := range s.FileDescriptors {
+		addMessages(fd.GetMessageTypes())
+		addEnums(fd.GetEnumTypes())
+		for _, sd := range fd.GetServices() {
+			schema.Services = append(schema.Services, Service{Name: sd.GetFullyQualifiedName(), Methods: s.methods(sd)})
+		}
+	}
+	return schema
+}
+
+// Describe returns the description of the fully-qualified message, enum or service name. Messages come with a JSON
+// skeleton that sets every field to a sample value.
+func (s *Server) Describe(name string) (*Description, error) {
+	switch d := s.findSymbol(name).(type) {
+	case *desc.MessageDescriptor:
+		skeleton, err := s.skeleton(d)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to render skeleton for '%v': %v", name, err)
+		}
+		fields := []Field{}
+		for _, fd := range d.GetFields() {
+			f := Field{
+				Name:     fd.GetName(),
+				JSONName: fd.GetJSONName(),
+				Number:   fd.GetNumber(),
+				Type:     fieldType(fd),
+				Comment:  comment(fd),
+			}
+			if oneof := fd.GetOneOf(); oneof != nil && !oneof.IsSynthetic() {
+				f.Oneof = oneof.GetName()
+			}
+			fields = append(fields, f)
+		}
+		return &Description{Kind: "message", Name: name, Comment: comment(d), Fields: fields, Skeleton: skeleton}, nil
+	case *desc.EnumDescriptor:
+		values := []EnumValue{}
+		for _, vd := range d.GetValues() {
+			values = append(values, EnumValue{Name: vd.GetName(), Number: vd.GetNumber(), Comment: comment(vd)})
+		}
+		return &Description{Kind: "enum", Name: name, Comment: comment(d), Values: values}, nil
+	case *desc.ServiceDescriptor:
+		return &Description{Kind: "service", Name: name, Comment: comment(d), Methods: s.methods(d)}, nil
+	default:
+		return nil, fmt.Errorf("Failed to find a message, enum or service named '%v'", name)
+	}
+}
+
+// findSymbol returns the descriptor for the fully-qualified name, or nil if no loaded file declares it.
+func (s *Server) findSymbol(name string) desc.Descriptor {
+	for _, fd := range s.FileDescriptors {
+		if d := fd.FindSymbol(name); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+func (s *Server) methods(sd *desc.ServiceDescriptor) []Method {
+	methods := []Method{}
+	for _, md := range sd.GetMethods() {
+		methods = append(methods, Method{
+			Name:            md.GetName(),
+			Input:           md.GetInputType().GetFullyQualifiedName(),
+			Output:          md.GetOutputType().GetFullyQualifiedName(),
+			ClientStreaming: md.IsClientStreaming(),
+			ServerStreaming: md.IsServerStreaming(),
+			Comment:         comment(md),
+			HTTP:            s.httpBindings(md),
+		})
+	}
+	return methods
+}
+
+// httpBindings returns the bindings in the google.api.http option of md, including its additional bindings.
+func (s *Server) httpBindings(md *desc.MethodDescriptor) []HTTPBinding {
+	opts, err := s.httpRules.parse(md)
+	if err != nil {
+		log.Log.WithError(err).WithField("method", md.GetFullyQualifiedName()).Warn("unable to read google.api.http option")
+	}
+	if opts == nil || len(s.httpRules.extensions) == 0 || !opts.HasField(s.httpRules.extensions[0]) {
+		return nil
+	}
+	rule, ok := opts.GetField(s.httpRules.extensions[0]).(*dynamic.Message)
+	if !ok {
+		return nil
+	}
+
+	var bindings []HTTPBinding
+	var addRule func(rule *dynamic.Message)
+	addRule = func(rule *dynamic.Message) {
+		b := HTTPBinding{}
+		for _, method := range []string{"get", "put", "post", "delete", "patch"} {
+			if path, _ := rule.GetFieldByName(method).(string); path != "" {
+				b.Method, b.Path = strings.ToUpper(method), path
+			}
+		}
+		if custom, ok := rule.GetFieldByName("custom").(*dynamic.Message); ok && b.Path == "" {
+			b.Method, _ = custom.GetFieldByName("kind").(string)
+			b.Path, _ = custom.GetFieldByName("path").(string)
+		}
+		b.Body, _ = rule.GetFieldByName("body").(string)
+		b.ResponseBody, _ = rule.GetFieldByName("response_body").(string)
+		if b.Path != "" {
+			bindings = append(bindings, b)
+		}
+		additional, _ := rule.GetFieldByName("additional_bindings").([]interface{})
+		for _, a := range additional {
+			if a, ok := a.(*dynamic.Message); ok {
+				addRule(a)
+			}
+		}
+	}
+	addRule(rule)
+	return bindings
+}
+
+// comment returns the leading comment of d, or its trailing comment if there is none. Comments are only available
+// for files parsed from source.
+func comment(d desc.Descriptor) string {
+	info := d.GetSourceInfo()
+	c := info.GetLeadingComments()
+	if strings.TrimSpace(c) == "" {
+		c = info.GetTrailingComments()
+	}
+	return strings.TrimSpace(c)
+}
+
+func fieldType(fd *desc.FieldDescriptor) string {
+	if fd.IsMap() {
+		return fmt.Sprintf("map<%v, %v>", fieldType(fd.GetMapKeyType()), fieldType(fd.GetMapValueType()))
+	}
+	var name string
+	switch {
+	case fd.GetMessageType() != nil:
+		name = fd.GetMessageType().GetFullyQualifiedName()
+	case fd.GetEnumType() != nil:
+		name = fd.GetEnumType().GetFullyQualifiedName()
+	default:
+		name = strings.ToLower(strings.TrimPrefix(fd.GetType().String(), "TYPE_"))
+	}
+
+	switch {
+	case fd.IsRepeated():
+		return "repeated " + name
+	case fd.IsRequired():
+		return "required " + name
+	case fd.IsProto3Optional():
+		return "optional " + name
+	}
+	return name
+}
+
+// pathParam matches a variable of an HTTP path template, such as {name} or {name=shelves/*}.
+var pathParam = regexp.MustCompile(`\{([^}=]+)(?:=([^}]*))?\}`)
+
+// bindings returns the HTTP bindings of m, a method of service. Methods without a google.api.http option are bound to
+// a POST to /<service>/<method> like gRPC.
+func (m Method) bindings(service string) []HTTPBinding {
+	if len(m.HTTP) > 0 {
+		return m.HTTP
+	}
+	return []HTTPBinding{{Method: "POST", Path: fmt.Sprintf("/%v/%v", service, m.Name), Body: "*"}}
+}
+
+// bindingMessages returns the messages Protoxy converts for calling md through b: the request field named by b.Body
+// and the response field named by b.ResponseBody. The whole input or output is used if the body is * or names a field
+// that isn't a message.
+func bindingMessages(md *desc.MethodDescriptor, b HTTPBinding) (reqMsg, respMsg *desc.MessageDescriptor) {
+	reqMsg = md.GetInputType()
+	if fd := reqMsg.FindFieldByName(b.Body); fd != nil && fd.GetMessageType() != nil && !fd.IsRepeated() {
+		reqMsg = fd.GetMessageType()
+	}
+	respMsg = md.GetOutputType()
+	if fd := respMsg.FindFieldByName(b.ResponseBody); fd != nil && fd.GetMessageType() != nil && !fd.IsRepeated() {
+		respMsg = fd.GetMessageType()
+	}
+	return reqMsg, respMsg
+}
+
+// skeleton returns the JSON of a message of type md with every field set to a sample value.
+func (s *Server) skeleton(md *desc.MessageDescriptor) ([]byte, error) {
+	return s.protoToJSON(skeletonMessage(md, map[string]bool{}))
+}
+
+// skeletonMessage returns a message of type md with every field set to a sample value: the default value of
+// scalars, a single element for repeated and map fields, and the first member of each oneof. Messages that are
+// already being filled in on the way down are left unset to stop recursion, as are Any and Value fields, which have
+// no sensible empty form.
+func skeletonMessage(md *desc.MessageDescriptor, seen map[string]bool) *dynamic.Message {
+	msg := dynamic.NewMessage(md)
+	if strings.HasPrefix(md.GetFullyQualifiedName(), "google.protobuf.") {
+		return msg
+	}
+	seen[md.GetFullyQualifiedName()] = true
+	defer delete(seen, md.GetFullyQualifiedName())
+
+	oneofs := map[*desc.OneOfDescriptor]bool{}
+	for _, fd := range md.GetFields() {
+		if oneof := fd.GetOneOf(); oneof != nil {
+			if oneofs[oneof] {
+				continue
+			}
+			oneofs[oneof] = true
+		}
+
+		if fd.IsMap() {
+			val, ok := skeletonValue(fd.GetMapValueType(), seen)
+			if ok {
+				msg.PutMapField(fd, fd.GetMapKeyType().GetDefaultValue(), val)
+			}
+			continue
+		}
+		val, ok := skeletonValue(fd, seen)
+		if !ok {
+			continue
+		}
+		if fd.IsRepeated() {
+			msg.AddRepeatedField(fd, val)
+		} else {
+			msg.SetField(fd, val)
+		}
+	}
+	return msg
+}
+
+// skeletonValue returns a sample value for a single element of fd, or false if fd is left unset.
+func skeletonValue(fd *desc.FieldDescriptor, seen map[string]bool) (interface{}, bool) {
+	mt := fd.GetMessageType()
+	if mt == nil {
+		return scalarValue(fd), true
+	}
+	switch mt.GetFullyQualifiedName() {
+	case "google.protobuf.Any", "google.protobuf.Value":
+		return nil, false
+	}
+	if seen[mt.GetFullyQualifiedName()] {
+		return nil, false
+	}
+	return skeletonMessage(mt, seen), true
+}
+
+// scalarValue returns the default value of a single element of fd. GetDefaultValue has no element value for
+// repeated fields.
+func scalarValue(fd *desc.FieldDescriptor) interface{} {
+	if !fd.IsRepeated() {
+		return fd.GetDefaultValue()
+	}
+	switch fd.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		return fd.GetEnumType().GetValues()[0].GetNumber()
+	case descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_TYPE_SINT32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int32(0)
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_SINT64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return int64(0)
+	case descriptor.FieldDescriptorProto_TYPE_UINT32, descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return uint32(0)
+	case descriptor.FieldDescriptorProto_TYPE_UINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64:
+		return uint64(0)
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return float32(0)
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return float64(0)
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return false
+	case descriptor.FieldDescriptorProto_TYPE_BYTES:
+		return []byte{}
+	default:
+		return ""
+	}
+}
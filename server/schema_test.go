@@ -0,0 +1,83 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchema(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"schema.proto", "presence.proto"})
+	require.NoError(t, err)
+	s := New(Config{FileDescriptors: fds})
+
+	t.Run("list", func(t *testing.T) {
+		schema := s.Schema()
+		assert.Equal(t, []string{"fixtures.Item", "fixtures.Dimensions", "fixtures.Presence", "fixtures.PresenceTree"}, schema.Messages)
+		assert.Equal(t, []string{"fixtures.Item.Kind"}, schema.Enums)
+		require.Len(t, schema.Services, 1)
+		assert.Equal(t, "fixtures.Catalog", schema.Services[0].Name)
+		assert.Equal(t, []Method{
+			{Name: "GetItem", Input: "fixtures.Item", Output: "fixtures.Item", Comment: "GetItem returns a single item."},
+			{Name: "WatchItems", Input: "fixtures.Item", Output: "fixtures.Item", ClientStreaming: true, ServerStreaming: true},
+		}, schema.Services[0].Methods)
+	})
+
+	t.Run("describe message", func(t *testing.T) {
+		d, err := s.Describe("fixtures.Item")
+		require.NoError(t, err)
+		assert.Equal(t, "message", d.Kind)
+		assert.Equal(t, "Item is something for sale.", d.Comment)
+		assert.Equal(t, []Field{
+			{Name: "name", JSONName: "name", Number: 1, Type: "string", Comment: "Unique name of the item."},
+			{Name: "price", JSONName: "price", Number: 2, Type: "int64", Comment: "In cents."},
+			{Name: "kind", JSONName: "kind", Number: 3, Type: "fixtures.Item.Kind"},
+			{Name: "tags", JSONName: "tags", Number: 4, Type: "repeated string"},
+			{Name: "stock", JSONName: "stock", Number: 5, Type: "map<string, int32>"},
+			{Name: "featured", JSONName: "featured", Number: 6, Type: "optional bool"},
+			{Name: "user", JSONName: "user", Number: 7, Type: "string", Oneof: "owner"},
+			{Name: "team", JSONName: "team", Number: 8, Type: "string", Oneof: "owner"},
+			{Name: "created", JSONName: "created", Number: 9, Type: "google.protobuf.Timestamp"},
+			{Name: "extra", JSONName: "extra", Number: 10, Type: "google.protobuf.Any"},
+			{Name: "related", JSONName: "related", Number: 11, Type: "repeated fixtures.Item"},
+			{Name: "dimensions", JSONName: "dimensions", Number: 12, Type: "fixtures.Dimensions"},
+		}, d.Fields)
+		assert.JSONEq(t, `{"name":"","price":"0","kind":"UNKNOWN","tags":[""],"stock":{"":0},"featured":false,"user":"","created":"1970-01-01T00:00:00Z","extra":null,"related":[],"dimensions":{"width":0,"height":0}}`, string(d.Skeleton))
+
+		// The skeleton is accepted as a request body
+		_, err = s.EncodeJSON(d.Skeleton, "fixtures.Item")
+		assert.NoError(t, err)
+	})
+
+	t.Run("skeleton sets optional fields", func(t *testing.T) {
+		d, err := s.Describe("fixtures.Presence")
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"count":0,"label":"","implicit":0,"flag":false}`, string(d.Skeleton))
+	})
+
+	t.Run("describe enum", func(t *testing.T) {
+		d, err := s.Describe("fixtures.Item.Kind")
+		require.NoError(t, err)
+		assert.Equal(t, "enum", d.Kind)
+		assert.Equal(t, []EnumValue{
+			{Name: "UNKNOWN", Number: 0},
+			{Name: "GOOD", Number: 1, Comment: "A physical good."},
+			{Name: "SERVICE", Number: 2},
+		}, d.Values)
+	})
+
+	t.Run("describe service", func(t *testing.T) {
+		d, err := s.Describe("fixtures.Catalog")
+		require.NoError(t, err)
+		assert.Equal(t, "service", d.Kind)
+		assert.Equal(t, "Catalog looks up items.", d.Comment)
+		assert.Len(t, d.Methods, 2)
+	})
+
+	t.Run("unknown name", func(t *testing.T) {
+		_, err := s.Describe("fixtures.Missing")
+		assert.Error(t, err)
+	})
+}
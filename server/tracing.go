@@ -0,0 +1,30 @@
+package server
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/camgraff/protoxy/server"
+
+// propagator reads W3C traceparent and baggage headers from requests and writes them to upstream requests.
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+func newTracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(tracerName)
+}
+
+// endProxySpan ends the root span of a proxied request, marking it as failed unless the request succeeded.
+func endProxySpan(span trace.Span, state *requestState) {
+	span.SetAttributes(attribute.String("protoxy.outcome", state.outcome))
+	if state.outcome != outcomeOK {
+		span.SetStatus(codes.Error, "request failed in the "+state.outcome+" stage")
+	}
+	span.End()
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTracing(t *testing.T) {
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	var upstreamTraceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		if r.URL.Path == "/garbage" {
+			w.Write([]byte{0xff, 0xff, 0xff})
+			return
+		}
+		resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+		require.NoError(t, err)
+		w.Write(resp)
+	}))
+	defer backend.Close()
+
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(t, err)
+
+	newTracedServer := func() (*Server, *tracetest.InMemoryExporter) {
+		exporter := tracetest.NewInMemoryExporter()
+		tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+		return New(Config{FileDescriptors: fds, TracerProvider: tp}), exporter
+	}
+	spansByName := func(spans tracetest.SpanStubs) map[string]tracetest.SpanStub {
+		byName := map[string]tracetest.SpanStub{}
+		for _, s := range spans {
+			byName[s.Name] = s
+		}
+		return byName
+	}
+	attributes := func(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		attrs := map[attribute.Key]attribute.Value{}
+		for _, kv := range s.Attributes {
+			attrs[kv.Key] = kv.Value
+		}
+		return attrs
+	}
+
+	t.Run("spans and propagation", func(t *testing.T) {
+		srv, exporter := newTracedServer()
+		req := httptest.NewRequest("POST", backend.URL, strings.NewReader(`{"text":"some text"}`))
+		req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+		respRecorder := httptest.NewRecorder()
+		srv.proxyRequest(respRecorder, req)
+		require.Equal(t, http.StatusOK, respRecorder.Code)
+
+		spans := spansByName(exporter.GetSpans())
+		require.Len(t, spans, 4)
+		root := spans["protoxy.proxy"]
+		assert.Equal(t, traceID, root.SpanContext.TraceID().String())
+		assert.Equal(t, parentSpanID, root.Parent.SpanID().String())
+		assert.Equal(t, "ok", attributes(root)["protoxy.outcome"].AsString())
+		for _, name := range []string{"protoxy.encode", "protoxy.upstream", "protoxy.decode"} {
+			assert.Equal(t, root.SpanContext.SpanID(), spans[name].Parent.SpanID(), name)
+		}
+
+		encode := attributes(spans["protoxy.encode"])
+		assert.Equal(t, "testprotos.Req", encode["protoxy.request_message"].AsString())
+		assert.Equal(t, int64(20), encode["protoxy.request.size"].AsInt64())
+		assert.Equal(t, int64(11), encode["protoxy.request.encoded_size"].AsInt64())
+
+		decode := attributes(spans["protoxy.decode"])
+		assert.Equal(t, "testprotos.Resp", decode["protoxy.response_message"].AsString())
+		assert.Equal(t, int64(20), decode["protoxy.response.size"].AsInt64())
+		assert.Equal(t, int64(29), decode["protoxy.response.decoded_size"].AsInt64())
+
+		// The upstream receives the trace with the upstream span as its parent
+		upstream := spans["protoxy.upstream"]
+		assert.Equal(t, "00-"+traceID+"-"+upstream.SpanContext.SpanID().String()+"-01", upstreamTraceparent)
+	})
+
+	t.Run("query string isn't recorded", func(t *testing.T) {
+		srv, exporter := newTracedServer()
+		req := httptest.NewRequest("POST", backend.URL+"/path?token=secret", strings.NewReader(`{"text":"some text"}`))
+		req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp; qs=q")
+		respRecorder := httptest.NewRecorder()
+		srv.proxyRequest(respRecorder, req)
+		require.Equal(t, http.StatusOK, respRecorder.Code)
+
+		upstream := attributes(spansByName(exporter.GetSpans())["protoxy.upstream"])
+		assert.Equal(t, backend.URL+"/path", upstream["url.full"].AsString())
+	})
+
+	t.Run("failed stage", func(t *testing.T) {
+		srv, exporter := newTracedServer()
+		req := httptest.NewRequest("POST", backend.URL+"/garbage", strings.NewReader(`{"text":"some text"}`))
+		req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+		respRecorder := httptest.NewRecorder()
+		srv.proxyRequest(respRecorder, req)
+		require.Equal(t, http.StatusBadRequest, respRecorder.Code)
+
+		spans := spansByName(exporter.GetSpans())
+		assert.Equal(t, codes.Error, spans["protoxy.decode"].Status.Code)
+		assert.Equal(t, codes.Error, spans["protoxy.proxy"].Status.Code)
+		assert.Equal(t, "decode", attributes(spans["protoxy.proxy"])["protoxy.outcome"].AsString())
+	})
+}
@@ -0,0 +1,440 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/camgraff/protoxy/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TransportConfig tunes the connections protoxy makes to upstream servers. Zero values use the defaults of
+// http.DefaultTransport.
+type TransportConfig struct {
+	// DialTimeout limits how long establishing a TCP connection may take.
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout limits how long the TLS handshake may take.
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout limits how long to wait for the response headers once the request has been written.
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout is how long an idle connection is kept in the pool.
+	IdleConnTimeout time.Duration
+	// MaxIdleConns limits the number of idle connections across all hosts.
+	MaxIdleConns int
+	// MaxIdleConnsPerHost limits the number of idle connections kept for each host.
+	MaxIdleConnsPerHost int
+	// MaxConnsPerHost limits the total number of connections to each host.
+	MaxConnsPerHost int
+	// Retries is the number of times a request with an idempotent method is retried when the upstream can't be
+	// connected to.
+	Retries int
+	// RetryBackoff is the delay before the first retry, at least 10ms. It doubles for each following retry, up to 10s.
+	RetryBackoff time.Duration
+	// TLSCAFile is a PEM file of certificate authorities to trust in addition to the system's.
+	TLSCAFile string
+	// TLSCertFile and TLSKeyFile are a PEM client certificate and its key, for upstreams that require mutual TLS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSInsecureSkipVerify disables checking upstream certificates. Only use it for testing.
+	TLSInsecureSkipVerify bool
+}
+
+// TLSConfig returns the TLS settings for upstream connections, or nil if cfg uses the defaults.
+func (cfg TransportConfig) TLSConfig() (*tls.Config, error) {
+	if cfg.TLSCAFile == "" && cfg.TLSCertFile == "" && cfg.TLSKeyFile == "" && !cfg.TLSInsecureSkipVerify {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+	if cfg.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read TLS CA file: %v", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in TLS CA file '%v'", cfg.TLSCAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load TLS client certificate: %v", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+// Request headers that override the TransportConfig for a single request. They are not forwarded upstream.
+const (
+	dialTimeoutHeader           = "X-Protoxy-Dial-Timeout"
+	tlsHandshakeTimeoutHeader   = "X-Protoxy-Tls-Handshake-Timeout"
+	responseHeaderTimeoutHeader = "X-Protoxy-Response-Header-Timeout"
+	retriesHeader               = "X-Protoxy-Retries"
+	retryBackoffHeader          = "X-Protoxy-Retry-Backoff"
+)
+
+// Bounds on retries, so that a client can't make one request hit the upstream without end. Retries from the
+// X-Protoxy-Retries header are capped at maxRetries, or the configured count if that is higher.
+const (
+	maxRetries      = 5
+	minRetryBackoff = 10 * time.Millisecond
+	maxRetryBackoff = 10 * time.Second
+)
+
+// upstream returns the key in Upstreams that matches the host of u, and its TransportConfig. Requests to other hosts
+// get an empty key and the server's Transport.
+func (s *Server) upstream(u *url.URL) (string, TransportConfig) {
+	if cfg, ok := s.Upstreams[u.Host]; ok {
+		return u.Host, cfg
+	}
+	if cfg, ok := s.Upstreams[u.Hostname()]; ok {
+		return u.Hostname(), cfg
+	}
+	return "", s.Transport
+}
+
+// parseTransportOverrides applies the X-Protoxy-* override headers of h to cfg and removes them from h.
+func parseTransportOverrides(h http.Header, cfg TransportConfig) (TransportConfig, error) {
+	durations := []struct {
+		header string
+		value  *time.Duration
+	}{
+		{dialTimeoutHeader, &cfg.DialTimeout},
+		{tlsHandshakeTimeoutHeader, &cfg.TLSHandshakeTimeout},
+		{responseHeaderTimeoutHeader, &cfg.ResponseHeaderTimeout},
+		{retryBackoffHeader, &cfg.RetryBackoff},
+	}
+	for _, d := range durations {
+		v := h.Get(d.header)
+		if v == "" {
+			continue
+		}
+		h.Del(d.header)
+		dur, err := time.ParseDuration(v)
+		if err != nil || dur < 0 {
+			return cfg, fmt.Errorf("invalid duration '%v' in %v header", v, d.header)
+		}
+		*d.value = dur
+	}
+
+	if v := h.Get(retriesHeader); v != "" {
+		h.Del(retriesHeader)
+		retries, err := strconv.Atoi(v)
+		if err != nil || retries < 0 {
+			return cfg, fmt.Errorf("invalid retry count '%v' in %v header", v, retriesHeader)
+		}
+		if limit := max(cfg.Retries, maxRetries); retries > limit {
+			retries = limit
+		}
+		cfg.Retries = retries
+	}
+	return cfg, nil
+}
+
+// Defaults of http.DefaultTransport, used when a TransportConfig leaves the timeouts at zero.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// transport is the http.RoundTripper used to reach upstreams. It keeps one pooled http.Transport for the server's
+// TransportConfig and one for each configured upstream. Requests carry their own timeouts in their requestState,
+// which are applied when connections are dialed and while waiting for response headers, so overriding them for a
+// request doesn't create another pool.
+type transport struct {
+	config TransportConfig
+	tracer trace.Tracer
+	pools  map[string]*upstreamPool
+}
+
+// upstreamPool is the http.Transport for one configured upstream, or the error loading its TLS settings.
+type upstreamPool struct {
+	transport *http.Transport
+	err       error
+}
+
+func newTransport(cfg TransportConfig, upstreams map[string]TransportConfig, tracer trace.Tracer) *transport {
+	t := &transport{
+		config: cfg,
+		tracer: tracer,
+		pools:  map[string]*upstreamPool{},
+	}
+	t.pools[""] = t.newPool(cfg)
+	for host, upstreamCfg := range upstreams {
+		t.pools[host] = t.newPool(upstreamCfg)
+	}
+	return t
+}
+
+// newPool returns the pooled http.Transport for the TLS settings in cfg. Pool settings only come from the server's
+// config, since the pools share its limits.
+func (t *transport) newPool(cfg TransportConfig) *upstreamPool {
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		log.Log.WithError(err).Error("unable to load upstream TLS settings")
+		return &upstreamPool{err: err}
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsCfg != nil {
+		tr.TLSClientConfig = tlsCfg
+	}
+	tr.DialContext = t.dial
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return t.dialTLS(ctx, tr, network, addr)
+	}
+	if t.config.IdleConnTimeout > 0 {
+		tr.IdleConnTimeout = t.config.IdleConnTimeout
+	}
+	if t.config.MaxIdleConns > 0 {
+		tr.MaxIdleConns = t.config.MaxIdleConns
+	}
+	if t.config.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = t.config.MaxIdleConnsPerHost
+	}
+	if t.config.MaxConnsPerHost > 0 {
+		tr.MaxConnsPerHost = t.config.MaxConnsPerHost
+	}
+	return &upstreamPool{transport: tr}
+}
+
+// requestConfig returns the TransportConfig of the request that ctx belongs to. The contexts of dials keep the
+// values of the request that started them.
+func (t *transport) requestConfig(ctx context.Context) TransportConfig {
+	if state := requestStateFrom(ctx); state != nil {
+		return state.transport
+	}
+	return t.config
+}
+
+// dial connects to addr within the dial timeout of the request.
+func (t *transport) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := t.requestConfig(ctx).DialTimeout
+	if timeout == 0 {
+		timeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// dialTLS connects to addr and completes the TLS handshake within the timeouts of the request.
+func (t *transport) dialTLS(ctx context.Context, tr *http.Transport, network, addr string) (net.Conn, error) {
+	conn, err := t.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	// The transport adds the ALPN protocols to its TLSClientConfig before dialing
+	tlsCfg := &tls.Config{}
+	if tr.TLSClientConfig != nil {
+		tlsCfg = tr.TLSClientConfig.Clone()
+	}
+	if tlsCfg.ServerName == "" {
+		tlsCfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	timeout := t.requestConfig(ctx).TLSHandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultTLSHandshakeTimeout
+	}
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, tlsCfg)
+	if err := tlsConn.HandshakeContext(handshakeCtx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// spanURL returns u without its query string, which may hold the encoded request, or user info.
+func spanURL(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath}).String()
+}
+
+// RoundTrip sends req upstream in its own span, and passes the trace on in req's headers.
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.tracer.Start(req.Context(), "protoxy.upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("server.address", req.URL.Host),
+		attribute.String("url.full", spanURL(req.URL)),
+	))
+	defer span.End()
+	propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	if req.ContentLength >= 0 {
+		span.SetAttributes(attribute.Int64("protoxy.request.encoded_size", req.ContentLength))
+	}
+
+	resp, err := t.roundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "upstream request failed")
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	return resp, nil
+}
+
+// roundTrip sends req upstream, retrying idempotent requests when the upstream can't be connected to. Other errors,
+// such as timeouts awaiting a response, are not retried, since the upstream may have acted on the request.
+func (t *transport) roundTrip(req *http.Request) (*http.Response, error) {
+	cfg := t.config
+	pool := t.pools[""]
+	if state := requestStateFrom(req.Context()); state != nil {
+		cfg = state.transport
+		if p, ok := t.pools[state.upstream]; ok {
+			pool = p
+		}
+	}
+	if pool.err != nil {
+		return nil, pool.err
+	}
+	if cfg.Retries == 0 || !isIdempotent(req) {
+		return send(pool.transport, req, cfg.ResponseHeaderTimeout)
+	}
+
+	// Buffer the body so it can be sent again
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	backoff := cfg.RetryBackoff
+	if backoff < minRetryBackoff {
+		backoff = minRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := send(pool.transport, req, cfg.ResponseHeaderTimeout)
+		if err == nil || attempt == cfg.Retries || req.Context().Err() != nil || !isDialError(err) {
+			return resp, err
+		}
+		log.FromContext(req.Context()).WithError(err).WithField("attempt", attempt+1).Warn("retrying request after connection error")
+		if err = sleep(req.Context(), backoff); err != nil {
+			return nil, err
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// isDialError reports whether err happened while connecting to the upstream, before any of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// send sends req with tr, and cancels it if the response headers don't arrive within timeout of the request being
+// written. A timeout of 0 waits forever.
+func send(tr *http.Transport, req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return tr.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var mu sync.Mutex
+	var timer *time.Timer
+	done, timedOut := false, false
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if done || timer != nil {
+				return
+			}
+			timer = time.AfterFunc(timeout, func() {
+				mu.Lock()
+				defer mu.Unlock()
+				if !done {
+					timedOut = true
+					cancel()
+				}
+			})
+		},
+	})
+
+	resp, err := tr.RoundTrip(req.WithContext(ctx))
+	mu.Lock()
+	done = true
+	if timer != nil {
+		timer.Stop()
+	}
+	mu.Unlock()
+	if err != nil {
+		cancel()
+		if timedOut {
+			return nil, fmt.Errorf("timeout awaiting response headers after %v", timeout)
+		}
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose cancels the context of a request once its response body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isIdempotent follows the rules net/http uses for its own retries.
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, hasKey := req.Header["Idempotency-Key"]
+	_, hasXKey := req.Header["X-Idempotency-Key"]
+	return hasKey || hasXKey
+}
+
+// closeIdleConnections closes the idle connections of every pooled http.Transport.
+func (t *transport) closeIdleConnections() {
+	for _, pool := range t.pools {
+		if pool.transport != nil {
+			pool.transport.CloseIdleConnections()
+		}
+	}
+}
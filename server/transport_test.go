@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/camgraff/protoxy/internal/testprotos"
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestParseTransportOverrides(t *testing.T) {
+	base := TransportConfig{DialTimeout: time.Second, Retries: 1}
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		expected TransportConfig
+		err      bool
+	}{
+		{
+			name:     "no overrides",
+			expected: base,
+		},
+		{
+			name: "all overrides",
+			headers: map[string]string{
+				"X-Protoxy-Dial-Timeout":            "2s",
+				"X-Protoxy-TLS-Handshake-Timeout":   "3s",
+				"X-Protoxy-Response-Header-Timeout": "500ms",
+				"X-Protoxy-Retries":                 "3",
+				"X-Protoxy-Retry-Backoff":           "10ms",
+			},
+			expected: TransportConfig{
+				DialTimeout:           2 * time.Second,
+				TLSHandshakeTimeout:   3 * time.Second,
+				ResponseHeaderTimeout: 500 * time.Millisecond,
+				Retries:               3,
+				RetryBackoff:          10 * time.Millisecond,
+			},
+		},
+		{
+			name:    "invalid duration",
+			headers: map[string]string{"X-Protoxy-Dial-Timeout": "soon"},
+			err:     true,
+		},
+		{
+			name:    "negative retries",
+			headers: map[string]string{"X-Protoxy-Retries": "-1"},
+			err:     true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			cfg, err := parseTransportOverrides(h, base)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, cfg)
+			assert.Empty(t, h, "override headers should not be forwarded")
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/testprotos"}, []string{"hello.proto"})
+	require.NoError(t, err)
+
+	resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+	require.NoError(t, err)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(resp)
+	}))
+	defer backend.Close()
+
+	// refuseDials makes the first failures dials of the upstream's pool fail as if the upstream refused the
+	// connection, and counts the dials
+	refuseDials := func(srv *Server, upstream string, failures int32) *int32 {
+		var dials int32
+		tr := srv.transport.pools[upstream].transport
+		dial := tr.DialContext
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) <= failures {
+				return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+			}
+			return dial(ctx, network, addr)
+		}
+		return &dials
+	}
+
+	tests := []struct {
+		name          string
+		method        string
+		retries       int
+		headers       map[string]string
+		failures      int32
+		expectedCode  int
+		expectedDials int32
+	}{
+		{
+			name:          "idempotent requests are retried",
+			method:        "GET",
+			retries:       2,
+			failures:      2,
+			expectedCode:  http.StatusOK,
+			expectedDials: 3,
+		},
+		{
+			name:          "retries are opt-in",
+			method:        "GET",
+			failures:      2,
+			expectedCode:  http.StatusBadRequest,
+			expectedDials: 1,
+		},
+		{
+			name:          "non-idempotent requests are not retried",
+			method:        "POST",
+			retries:       2,
+			failures:      2,
+			expectedCode:  http.StatusBadRequest,
+			expectedDials: 1,
+		},
+		{
+			name:          "retries from header",
+			method:        "POST",
+			headers:       map[string]string{"X-Protoxy-Retries": "2", "Idempotency-Key": "abc"},
+			failures:      2,
+			expectedCode:  http.StatusOK,
+			expectedDials: 3,
+		},
+		{
+			name:          "retries from header are capped",
+			method:        "GET",
+			headers:       map[string]string{"X-Protoxy-Retries": "1000000000", "X-Protoxy-Retry-Backoff": "0s"},
+			failures:      1000,
+			expectedCode:  http.StatusBadRequest,
+			expectedDials: maxRetries + 1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, backend.URL, strings.NewReader(`{"text":"some text"}`))
+			req.Header.Add("Content-Type", "application/json; reqMsg=testprotos.Req; respMsg=testprotos.Resp")
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			respRecorder := httptest.NewRecorder()
+			srv := New(Config{FileDescriptors: fds, Transport: TransportConfig{Retries: tc.retries, RetryBackoff: time.Millisecond}})
+			dials := refuseDials(srv, "", tc.failures)
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, tc.expectedCode, respRecorder.Code)
+			assert.Equal(t, tc.expectedDials, atomic.LoadInt32(dials))
+		})
+	}
+
+	t.Run("response header timeouts are not retried", func(t *testing.T) {
+		var calls int32
+		slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer slow.Close()
+
+		req := httptest.NewRequest("GET", slow.URL, nil)
+		req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds, Transport: TransportConfig{Retries: 2, ResponseHeaderTimeout: 20 * time.Millisecond}})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+	})
+
+	t.Run("response header timeout from header", func(t *testing.T) {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("X-Protoxy-Response-Header-Timeout"))
+			time.Sleep(200 * time.Millisecond)
+		}))
+		defer backend.Close()
+
+		req := httptest.NewRequest("GET", backend.URL, nil)
+		req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+		req.Header.Set("X-Protoxy-Response-Header-Timeout", "20ms")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{FileDescriptors: fds})
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+	})
+	t.Run("overrides don't add connection pools", func(t *testing.T) {
+		// The listener accepts connections but never answers, so TLS handshakes hang
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		srv := New(Config{FileDescriptors: fds})
+		for _, timeout := range []string{"20ms", "30ms", "40ms"} {
+			req := httptest.NewRequest("GET", "https://"+listener.Addr().String(), nil)
+			req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+			req.Header.Set("X-Protoxy-Tls-Handshake-Timeout", timeout)
+			respRecorder := httptest.NewRecorder()
+			start := time.Now()
+			srv.proxyRequest(respRecorder, req)
+
+			assert.Equal(t, http.StatusBadRequest, respRecorder.Code)
+			assert.Less(t, time.Since(start), time.Second)
+		}
+		assert.Len(t, srv.transport.pools, 1)
+	})
+
+	t.Run("upstream settings replace the defaults", func(t *testing.T) {
+		u, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+
+		req := httptest.NewRequest("GET", backend.URL, nil)
+		req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+		respRecorder := httptest.NewRecorder()
+		srv := New(Config{
+			FileDescriptors: fds,
+			Upstreams:       map[string]TransportConfig{u.Hostname(): {Retries: 2, RetryBackoff: time.Millisecond}},
+		})
+		dials := refuseDials(srv, u.Hostname(), 2)
+		srv.proxyRequest(respRecorder, req)
+
+		assert.Equal(t, http.StatusOK, respRecorder.Code)
+		assert.Equal(t, int32(3), atomic.LoadInt32(dials))
+	})
+
+	t.Run("TLS CA file", func(t *testing.T) {
+		backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			resp, err := proto.Marshal(&testprotos.Resp{Text: "This is a response"})
+			require.NoError(t, err)
+			w.Write(resp)
+		}))
+		defer backend.Close()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+		require.NoError(t, ioutil.WriteFile(caFile, ca, 0600))
+
+		for _, tc := range []struct {
+			name         string
+			cfg          TransportConfig
+			expectedCode int
+		}{
+			{"untrusted", TransportConfig{}, http.StatusBadRequest},
+			{"trusted", TransportConfig{TLSCAFile: caFile}, http.StatusOK},
+			{"verification skipped", TransportConfig{TLSInsecureSkipVerify: true}, http.StatusOK},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				req := httptest.NewRequest("GET", backend.URL, nil)
+				req.Header.Add("Content-Type", "application/x-protobuf; respMsg=testprotos.Resp")
+				respRecorder := httptest.NewRecorder()
+				srv := New(Config{FileDescriptors: fds, Transport: tc.cfg})
+				srv.proxyRequest(respRecorder, req)
+
+				assert.Equal(t, tc.expectedCode, respRecorder.Code)
+			})
+		}
+	})
+}
+
+func TestTLSConfig(t *testing.T) {
+	tlsCfg, err := TransportConfig{}.TLSConfig()
+	require.NoError(t, err)
+	assert.Nil(t, tlsCfg)
+
+	_, err = TransportConfig{TLSCAFile: "missing.pem"}.TLSConfig()
+	assert.Error(t, err)
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600))
+	_, err = TransportConfig{TLSCAFile: notPEM}.TLSConfig()
+	assert.Error(t, err)
+
+	_, err = TransportConfig{TLSCertFile: "missing.pem"}.TLSConfig()
+	assert.Error(t, err)
+}
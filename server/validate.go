@@ -0,0 +1,464 @@
+package server
+
+import (
+	"fmt"
+	"math/big"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/camgraff/protoxy/log"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/dynamic"
+)
+
+// ruleExtensions are the field options that carry validation rules: protoc-gen-validate's (validate.rules) and
+// protovalidate's (buf.validate.field).
+var ruleExtensions = map[string]bool{
+	"validate.rules":     true,
+	"buf.validate.field": true,
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// violation describes a single field that failed validation.
+type violation struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// validationError is returned when a request message violates the rules declared in its descriptor.
+type validationError struct {
+	Violations []violation `json:"violations"`
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		msgs[i] = v.Field + ": " + v.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Values of protovalidate's (buf.validate.field).ignore, which skips the rules of a field for some values.
+// IGNORE_IF_UNPOPULATED is called IGNORE_IF_ZERO_VALUE in newer releases.
+const (
+	ignoreIfUnpopulated  = 1
+	ignoreIfDefaultValue = 2
+	ignoreAlways         = 3
+)
+
+// validator checks dynamic messages against the validation rules found in the loaded descriptors.
+type validator struct {
+	options *optionsParser
+
+	mu       sync.Mutex
+	rules    map[*desc.FieldDescriptor]*dynamic.Message
+	patterns map[*desc.FieldDescriptor]*compiledPattern
+}
+
+// compiledPattern is the compiled pattern rule of a field, or the error compiling it.
+type compiledPattern struct {
+	re  *regexp.Regexp
+	err error
+}
+
+func newValidator(files []*desc.FileDescriptor) (*validator, error) {
+	options, err := newOptionsParser(files, "google.protobuf.FieldOptions", ruleExtensions)
+	if err != nil {
+		return nil, err
+	}
+	return &validator{
+		options:  options,
+		rules:    map[*desc.FieldDescriptor]*dynamic.Message{},
+		patterns: map[*desc.FieldDescriptor]*compiledPattern{},
+	}, nil
+}
+
+// rulesFor returns the validation rules declared on fd, or nil if it has none.
+func (v *validator) rulesFor(fd *desc.FieldDescriptor) *dynamic.Message {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if rules, ok := v.rules[fd]; ok {
+		return rules
+	}
+
+	var rules *dynamic.Message
+	opts, err := v.options.parse(fd)
+	if err != nil {
+		log.Log.WithError(err).WithField("field", fd.GetFullyQualifiedName()).Warn("unable to read validation rules")
+	}
+	if opts != nil {
+		for _, ext := range v.options.extensions {
+			if opts.HasField(ext) {
+				rules, _ = opts.GetField(ext).(*dynamic.Message)
+				break
+			}
+		}
+	}
+	v.rules[fd] = rules
+	return rules
+}
+
+// pattern returns the compiled pattern rule of fd. Each field has a single pattern, so it is compiled only once.
+func (v *validator) pattern(fd *desc.FieldDescriptor, pattern string) (*regexp.Regexp, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	p, ok := v.patterns[fd]
+	if !ok {
+		p = &compiledPattern{}
+		p.re, p.err = regexp.Compile(pattern)
+		v.patterns[fd] = p
+	}
+	return p.re, p.err
+}
+
+// validateMessage checks msg and all of its nested messages, and returns every violation in field order.
+func (v *validator) validateMessage(path string, msg *dynamic.Message) []violation {
+	var violations []violation
+	for _, fd := range msg.GetMessageDescriptor().GetFields() {
+		fieldPath := fd.GetName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		val := msg.GetField(fd)
+		rules := v.rulesFor(fd)
+		if rules != nil {
+			ignore, _ := ruleValue(rules, "ignore").(int32)
+			if ignore == ignoreAlways {
+				continue
+			}
+			if !isIgnored(ignore, fd, val, msg.HasField(fd)) {
+				violations = append(violations, v.checkField(fieldPath, fd, rules, val, msg.HasField(fd))...)
+			}
+			if skip, _ := ruleValue(rules, "message", "skip").(bool); skip {
+				continue
+			}
+		}
+
+		// Recurse into nested messages
+		switch {
+		case fd.IsMap():
+			if fd.GetMapValueType().GetMessageType() == nil {
+				continue
+			}
+			m := val.(map[interface{}]interface{})
+			for _, k := range sortedMapKeys(m) {
+				if nested, ok := m[k].(*dynamic.Message); ok {
+					violations = append(violations, v.validateMessage(fmt.Sprintf("%s[%v]", fieldPath, k), nested)...)
+				}
+			}
+		case fd.IsRepeated():
+			for i, e := range val.([]interface{}) {
+				if nested, ok := e.(*dynamic.Message); ok {
+					violations = append(violations, v.validateMessage(fmt.Sprintf("%s[%d]", fieldPath, i), nested)...)
+				}
+			}
+		case msg.HasField(fd):
+			if nested, ok := val.(*dynamic.Message); ok {
+				violations = append(violations, v.validateMessage(fieldPath, nested)...)
+			}
+		}
+	}
+	return violations
+}
+
+// isIgnored reports whether the rules of fd are skipped for val, given protovalidate's ignore setting. Unpopulated
+// fields are unset fields with presence, fields without presence that hold their zero value, and empty lists and
+// maps.
+func isIgnored(ignore int32, fd *desc.FieldDescriptor, val interface{}, present bool) bool {
+	switch ignore {
+	case ignoreIfUnpopulated:
+		return !present
+	case ignoreIfDefaultValue:
+		return !present || (!fd.IsRepeated() && reflect.DeepEqual(val, fd.GetDefaultValue()))
+	}
+	return false
+}
+
+// checkField applies the rules declared on a single field to its value.
+func (v *validator) checkField(path string, fd *desc.FieldDescriptor, rules *dynamic.Message, val interface{}, present bool) []violation {
+	var violations []violation
+	if required, _ := ruleValue(rules, "required").(bool); required && !present {
+		violations = append(violations, violation{path, "required", "value is required"})
+	}
+	if required, _ := ruleValue(rules, "message", "required").(bool); required && !present {
+		violations = append(violations, violation{path, "message.required", "value is required"})
+	}
+
+	switch {
+	case fd.IsMap():
+		mapRules, _ := ruleValue(rules, "map").(*dynamic.Message)
+		if mapRules != nil {
+			violations = append(violations, v.checkMap(path, fd, mapRules, val.(map[interface{}]interface{}))...)
+		}
+	case fd.IsRepeated():
+		repeatedRules, _ := ruleValue(rules, "repeated").(*dynamic.Message)
+		if repeatedRules != nil {
+			violations = append(violations, v.checkRepeated(path, fd, repeatedRules, val.([]interface{}))...)
+		}
+	default:
+		violations = append(violations, v.checkValue(path, fd, rules, val)...)
+	}
+	return violations
+}
+
+func (v *validator) checkRepeated(path string, fd *desc.FieldDescriptor, rules *dynamic.Message, list []interface{}) []violation {
+	var violations []violation
+	if min, ok := ruleValue(rules, "min_items").(uint64); ok && uint64(len(list)) < min {
+		violations = append(violations, violation{path, "repeated.min_items", fmt.Sprintf("value must contain at least %d item(s)", min)})
+	}
+	if max, ok := ruleValue(rules, "max_items").(uint64); ok && uint64(len(list)) > max {
+		violations = append(violations, violation{path, "repeated.max_items", fmt.Sprintf("value must contain no more than %d item(s)", max)})
+	}
+	if unique, _ := ruleValue(rules, "unique").(bool); unique {
+		for i := range list {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(list[i], list[j]) {
+					violations = append(violations, violation{fmt.Sprintf("%s[%d]", path, i), "repeated.unique", "repeated value must contain unique items"})
+					break
+				}
+			}
+		}
+	}
+	if items, _ := ruleValue(rules, "items").(*dynamic.Message); items != nil {
+		for i, e := range list {
+			violations = append(violations, v.checkValue(fmt.Sprintf("%s[%d]", path, i), fd, items, e)...)
+		}
+	}
+	return violations
+}
+
+func (v *validator) checkMap(path string, fd *desc.FieldDescriptor, rules *dynamic.Message, m map[interface{}]interface{}) []violation {
+	var violations []violation
+	if min, ok := ruleValue(rules, "min_pairs").(uint64); ok && uint64(len(m)) < min {
+		violations = append(violations, violation{path, "map.min_pairs", fmt.Sprintf("map must be at least %d entries", min)})
+	}
+	if max, ok := ruleValue(rules, "max_pairs").(uint64); ok && uint64(len(m)) > max {
+		violations = append(violations, violation{path, "map.max_pairs", fmt.Sprintf("map must be at most %d entries", max)})
+	}
+	keys, _ := ruleValue(rules, "keys").(*dynamic.Message)
+	values, _ := ruleValue(rules, "values").(*dynamic.Message)
+	for _, k := range sortedMapKeys(m) {
+		// Violations of the key rules are reported at field[key]#key, and of the value rules at field[key]
+		entryPath := fmt.Sprintf("%s[%v]", path, k)
+		if keys != nil {
+			violations = append(violations, v.checkValue(entryPath+"#key", fd.GetMapKeyType(), keys, k)...)
+		}
+		if values != nil {
+			violations = append(violations, v.checkValue(entryPath, fd.GetMapValueType(), values, m[k])...)
+		}
+	}
+	return violations
+}
+
+// sortedMapKeys returns the keys of m in order, so that violations are reported in the same order every time.
+func sortedMapKeys(m map[interface{}]interface{}) []interface{} {
+	keys := make([]interface{}, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if c, ok := compareNumbers(keys[i], keys[j]); ok {
+			return c < 0
+		}
+		return toString(keys[i]) < toString(keys[j])
+	})
+	return keys
+}
+
+// checkValue applies the type-specific rules, such as (validate.rules).string, to a single value.
+func (v *validator) checkValue(path string, fd *desc.FieldDescriptor, rules *dynamic.Message, val interface{}) []violation {
+	var violations []violation
+	for _, kindField := range rules.GetKnownFields() {
+		typeRules, ok := rules.GetField(kindField).(*dynamic.Message)
+		kind := kindField.GetName()
+		if !ok || !rules.HasField(kindField) || kind == "message" || kind == "repeated" || kind == "map" {
+			continue
+		}
+		if ignoreEmpty, _ := ruleValue(typeRules, "ignore_empty").(bool); ignoreEmpty && isZero(val) {
+			continue
+		}
+		for _, rf := range typeRules.GetKnownFields() {
+			if !typeRules.HasField(rf) {
+				continue
+			}
+			if msg := v.checkRule(fd, rf.GetName(), typeRules.GetField(rf), val); msg != "" {
+				violations = append(violations, violation{path, kind + "." + rf.GetName(), msg})
+			}
+		}
+	}
+	return violations
+}
+
+// checkRule evaluates a single rule and returns a description of the violation, or "" if the value is valid.
+// Rules that protoxy does not understand are ignored.
+func (v *validator) checkRule(fd *desc.FieldDescriptor, name string, want interface{}, val interface{}) string {
+	switch name {
+	case "const":
+		if !reflect.DeepEqual(val, want) {
+			return fmt.Sprintf("value must equal %v", want)
+		}
+	case "lt", "lte", "gt", "gte":
+		cmp, ok := compareNumbers(val, want)
+		if !ok {
+			return ""
+		}
+		switch {
+		case name == "lt" && cmp >= 0:
+			return fmt.Sprintf("value must be less than %v", want)
+		case name == "lte" && cmp > 0:
+			return fmt.Sprintf("value must be less than or equal to %v", want)
+		case name == "gt" && cmp <= 0:
+			return fmt.Sprintf("value must be greater than %v", want)
+		case name == "gte" && cmp < 0:
+			return fmt.Sprintf("value must be greater than or equal to %v", want)
+		}
+	case "in", "not_in":
+		found := false
+		for _, w := range want.([]interface{}) {
+			if reflect.DeepEqual(val, w) {
+				found = true
+				break
+			}
+		}
+		if name == "in" && !found {
+			return fmt.Sprintf("value must be in list %v", want)
+		}
+		if name == "not_in" && found {
+			return fmt.Sprintf("value must not be in list %v", want)
+		}
+	case "len", "min_len", "max_len", "len_bytes", "min_bytes", "max_bytes":
+		var n uint64
+		switch val := val.(type) {
+		case string:
+			n = uint64(utf8.RuneCountInString(val))
+			if strings.HasSuffix(name, "bytes") {
+				n = uint64(len(val))
+			}
+		case []byte:
+			n = uint64(len(val))
+		default:
+			return ""
+		}
+		want, _ := want.(uint64)
+		switch {
+		case (name == "len" || name == "len_bytes") && n != want:
+			return fmt.Sprintf("value length must be %d", want)
+		case (name == "min_len" || name == "min_bytes") && n < want:
+			return fmt.Sprintf("value length must be at least %d", want)
+		case (name == "max_len" || name == "max_bytes") && n > want:
+			return fmt.Sprintf("value length must be at most %d", want)
+		}
+	case "pattern":
+		re, err := v.pattern(fd, fmt.Sprint(want))
+		if err != nil {
+			return fmt.Sprintf("invalid pattern %q: %v", want, err)
+		}
+		if !re.MatchString(toString(val)) {
+			return fmt.Sprintf("value does not match regex pattern %q", want)
+		}
+	case "prefix":
+		if !strings.HasPrefix(toString(val), toString(want)) {
+			return fmt.Sprintf("value does not have prefix %q", toString(want))
+		}
+	case "suffix":
+		if !strings.HasSuffix(toString(val), toString(want)) {
+			return fmt.Sprintf("value does not have suffix %q", toString(want))
+		}
+	case "contains":
+		if !strings.Contains(toString(val), toString(want)) {
+			return fmt.Sprintf("value does not contain substring %q", toString(want))
+		}
+	case "not_contains":
+		if strings.Contains(toString(val), toString(want)) {
+			return fmt.Sprintf("value contains substring %q", toString(want))
+		}
+	case "email":
+		if want == true {
+			if _, err := mail.ParseAddress(toString(val)); err != nil {
+				return "value must be a valid email address"
+			}
+		}
+	case "uuid":
+		if want == true && !uuidPattern.MatchString(toString(val)) {
+			return "value must be a valid UUID"
+		}
+	case "defined_only":
+		if want == true && fd.GetEnumType() != nil {
+			if n, ok := val.(int32); ok && fd.GetEnumType().FindValueByNumber(n) == nil {
+				return "value must be one of the defined enum values"
+			}
+		}
+	}
+	return ""
+}
+
+// ruleValue returns the value at the given path of rule names, or nil if any part of it is unset.
+func ruleValue(rules *dynamic.Message, path ...string) interface{} {
+	var val interface{} = rules
+	for _, name := range path {
+		msg, ok := val.(*dynamic.Message)
+		if !ok {
+			return nil
+		}
+		fd := msg.GetMessageDescriptor().FindFieldByName(name)
+		if fd == nil || !msg.HasField(fd) {
+			return nil
+		}
+		val = msg.GetField(fd)
+	}
+	return val
+}
+
+func compareNumbers(a, b interface{}) (int, bool) {
+	x, ok := toBigFloat(a)
+	if !ok {
+		return 0, false
+	}
+	y, ok := toBigFloat(b)
+	if !ok {
+		return 0, false
+	}
+	return x.Cmp(y), true
+}
+
+func toBigFloat(v interface{}) (*big.Float, bool) {
+	f := new(big.Float)
+	switch v := v.(type) {
+	case int32:
+		return f.SetInt64(int64(v)), true
+	case int64:
+		return f.SetInt64(v), true
+	case uint32:
+		return f.SetUint64(uint64(v)), true
+	case uint64:
+		return f.SetUint64(v), true
+	case float32:
+		return f.SetFloat64(float64(v)), true
+	case float64:
+		return f.SetFloat64(v), true
+	}
+	return nil, false
+}
+
+func toString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	s, _ := v.(string)
+	return s
+}
+
+func isZero(v interface{}) bool {
+	if b, ok := v.([]byte); ok {
+		return len(b) == 0
+	}
+	return v == nil || reflect.DeepEqual(v, reflect.Zero(reflect.TypeOf(v)).Interface())
+}
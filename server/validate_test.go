@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/camgraff/protoxy/protoparser"
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/jhump/protoreflect/dynamic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	fds, err := protoparser.FileDescriptorsFromPaths([]string{"../internal/fixtures"}, []string{"validated.proto"})
+	require.NoError(t, err)
+	v, err := newValidator(fds)
+	require.NoError(t, err)
+	md := fds[0].FindMessage("fixtures.Validated")
+	require.NotNil(t, md)
+
+	tt := []struct {
+		name       string
+		body       string
+		violations []violation
+	}{
+		{
+			name: "valid",
+			body: `{"name":"alice","age":30,"tags":["t1","t2"],"child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"color":"RED","email":"a@example.com"}`,
+		},
+		{
+			name: "missing required fields",
+			body: `{"name":"alice"}`,
+			violations: []violation{
+				{"child", "message.required", "value is required"},
+				{"email", "required", "value is required"},
+			},
+		},
+		{
+			name: "scalar rules",
+			body: `{"name":"al","age":150,"child":{},"color":7,"email":"a-very-long-address@example.com"}`,
+			violations: []violation{
+				{"name", "string.min_len", "value length must be at least 3"},
+				{"age", "int32.lt", "value must be less than 150"},
+				{"child.id", "string.uuid", "value must be a valid UUID"},
+				{"color", "enum.defined_only", "value must be one of the defined enum values"},
+				{"email", "string.max_len", "value length must be at most 20"},
+			},
+		},
+		{
+			name: "repeated rules",
+			body: `{"name":"alice","tags":["t1","x","t1"],"child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"email":"a@example.com"}`,
+			violations: []violation{
+				{"tags", "repeated.max_items", "value must contain no more than 2 item(s)"},
+				{"tags[2]", "repeated.unique", "repeated value must contain unique items"},
+				{"tags[1]", "string.prefix", `value does not have prefix "t"`},
+			},
+		},
+		{
+			name: "map rules in key order",
+			body: `{"name":"alice","child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"email":"a@example.com","children":{"d":{"id":"x"},"b":{},"c":{"id":"y"},"a":{"id":"z"}}}`,
+			violations: []violation{
+				{"children[a]#key", "string.min_len", "value length must be at least 2"},
+				{"children[b]#key", "string.min_len", "value length must be at least 2"},
+				{"children[c]#key", "string.min_len", "value length must be at least 2"},
+				{"children[d]#key", "string.min_len", "value length must be at least 2"},
+				{"children[a].id", "string.uuid", "value must be a valid UUID"},
+				{"children[b].id", "string.uuid", "value must be a valid UUID"},
+				{"children[c].id", "string.uuid", "value must be a valid UUID"},
+				{"children[d].id", "string.uuid", "value must be a valid UUID"},
+			},
+		},
+		{
+			name: "map key and value rules",
+			body: `{"name":"alice","child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"email":"a@example.com","children":{"a":{"id":"x"}}}`,
+			violations: []violation{
+				{"children[a]#key", "string.min_len", "value length must be at least 2"},
+				{"children[a].id", "string.uuid", "value must be a valid UUID"},
+			},
+		},
+		{
+			name: "pattern",
+			body: `{"name":"alice","child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"email":"a@example.com","code":"abc"}`,
+			violations: []violation{
+				{"code", "string.pattern", `value does not match regex pattern "^[A-Z]*$"`},
+			},
+		},
+		{
+			name: "ignored if unpopulated",
+			body: `{"name":"alice","child":{"id":"123e4567-e89b-12d3-a456-426614174000"},"email":"a@example.com","nickname":"al"}`,
+			violations: []violation{
+				{"nickname", "string.min_len", "value length must be at least 3"},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := dynamic.NewMessage(md)
+			require.NoError(t, jsonpb.UnmarshalString(tc.body, msg))
+
+			// Run it more than once, since map iteration order is random
+			for i := 0; i < 5; i++ {
+				assert.Equal(t, tc.violations, v.validateMessage("", msg))
+			}
+		})
+	}
+	// Patterns are compiled once per field
+	assert.Len(t, v.patterns, 1)
+}